@@ -0,0 +1,89 @@
+package example
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+	"github.com/adamcolton/rye/thresher"
+	"github.com/stretchr/testify/assert"
+)
+
+// Color encodes itself as text for TestEncodingMarshalers. ryegen only reads
+// shapes.go so it does not see these methods.
+func (c Color) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("color-%d", c)), nil
+}
+
+func (c *Color) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "color-%d", c)
+	return err
+}
+
+// colorCodec writes a Color as a fixed width byte offset by one so that it is
+// not the same as a varint.
+type colorCodec struct{}
+
+func (colorCodec) Size(p unsafe.Pointer) int  { return 1 }
+func (colorCodec) Zero(p unsafe.Pointer) bool { return *(*Color)(p) == 0 }
+
+func (colorCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	s.Byte(byte(*(*Color)(p)) + 1)
+	return nil
+}
+
+func (colorCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	*(*Color)(p) = Color(d.Byte() - 1)
+	return nil
+}
+
+func testShape() *Shape {
+	return &Shape{
+		ID:     1,
+		Color:  3,
+		Anchor: &Point{X: 1},
+		Next:   &Shape{ID: 2, Color: 4, Scale: 1.5, Delta: -1, Meta: Meta{Name: "unnamed"}},
+		Scale:  2,
+		Meta:   Meta{Name: "outer"},
+	}
+}
+
+// checkRoundTrip checks that th can read what it writes and that it writes the
+// same bytes as reflection.
+func checkRoundTrip(t *testing.T, th, reflection *thresher.Thresher) {
+	s := testShape()
+	b, err := th.Marshal(s, nil)
+	assert.NoError(t, err)
+	expected, err := reflection.Marshal(s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, b)
+
+	got, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, s, got)
+}
+
+// TestEncodingMarshalers checks that a struct with a field that encodes itself
+// as text is encoded by reflection rather than by its generated methods.
+func TestEncodingMarshalers(t *testing.T) {
+	th := &thresher.Thresher{EncodingMarshalers: true}
+	assert.NoError(t, th.RegisterNamed("example.Shape", (*Shape)(nil)))
+	reflection := &thresher.Thresher{EncodingMarshalers: true, IgnoreGenerated: true}
+	assert.NoError(t, reflection.RegisterNamed("example.Shape", (*Shape)(nil)))
+	checkRoundTrip(t, th, reflection)
+}
+
+// TestRegisterCodec checks that a struct with a field that has a Codec is
+// encoded by reflection rather than by its generated methods.
+func TestRegisterCodec(t *testing.T) {
+	colorType := reflect.TypeOf(Color(0))
+	th := &thresher.Thresher{}
+	assert.NoError(t, th.RegisterCodec(colorType, colorCodec{}))
+	assert.NoError(t, th.RegisterNamed("example.Shape", (*Shape)(nil)))
+	reflection := &thresher.Thresher{IgnoreGenerated: true}
+	assert.NoError(t, reflection.RegisterCodec(colorType, colorCodec{}))
+	assert.NoError(t, reflection.RegisterNamed("example.Shape", (*Shape)(nil)))
+	checkRoundTrip(t, th, reflection)
+}
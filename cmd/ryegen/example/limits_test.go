@@ -0,0 +1,44 @@
+package example
+
+import (
+	"testing"
+
+	"github.com/adamcolton/rye"
+	"github.com/adamcolton/rye/thresher"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLimits checks that the Limits of a Thresher apply to types with
+// generated methods.
+func TestLimits(t *testing.T) {
+	th := &thresher.Thresher{}
+	assert.NoError(t, th.RegisterNamed("example.Shape", (*Shape)(nil)))
+
+	s := &Shape{ID: 1, Weights: make([]int32, 5000)}
+	for i := range s.Weights {
+		s.Weights[i] = 1
+	}
+	b, err := th.Marshal(s, nil)
+	assert.NoError(t, err)
+	th.Limits = thresher.Limits{MaxSliceLen: 10}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, thresher.ErrLimit{Limit: "MaxSliceLen", Value: 5000, Max: 10}, err)
+
+	s = &Shape{ID: 1}
+	for i := 0; i < 50; i++ {
+		s = &Shape{ID: 1, Next: s}
+	}
+	th.Limits = thresher.Limits{}
+	b, err = th.Marshal(s, nil)
+	assert.NoError(t, err)
+	th.Limits = thresher.Limits{MaxDepth: 5}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, thresher.ErrLimit{Limit: "MaxDepth", Value: 6, Max: 5}, err)
+
+	// without a Thresher only DefaultSliceThreshold applies
+	s = &Shape{ID: 1, Weights: make([]int32, thresher.DefaultSliceThreshold+1)}
+	b, err = rye.Marshal(s)
+	assert.NoError(t, err)
+	err = new(Shape).Unmarshal(rye.NewDeserializer(b))
+	assert.Equal(t, thresher.ErrLimit{Limit: "MaxSliceLen", Value: thresher.DefaultSliceThreshold + 1, Max: thresher.DefaultSliceThreshold}, err)
+}
@@ -0,0 +1,45 @@
+// Package example has types with methods written by ryegen. Its tests check
+// the generated methods against thresher.
+package example
+
+import "errors"
+
+//go:generate go run github.com/adamcolton/rye/cmd/ryegen -test $GOFILE
+
+type Color uint8
+
+type Point struct {
+	X float64 `RyeField:"1,required"`
+	Y float64 `RyeField:"2,always"`
+}
+
+type Meta struct {
+	Name string   `RyeField:"1" RyeDefault:"unnamed"`
+	Tags []string `RyeField:"2,always"`
+}
+
+type Shape struct {
+	Meta    `RyeField:",flatten"`
+	Kind    int8       `RyeField:"3,always"`
+	Color   Color      `RyeField:"4"`
+	Origin  Point      `RyeField:"5,always"`
+	Path    []Point    `RyeField:"6"`
+	Anchor  *Point     `RyeField:"7"`
+	Holes   [][]*Point `RyeField:"8"`
+	Scale   float32    `RyeField:"9,default=1.5"`
+	ID      uint64     `RyeField:"10,required"`
+	Delta   int        `RyeField:"11,default=-1"`
+	Data    []byte     `RyeField:"12"`
+	Weights []int32    `RyeField:"13"`
+	Next    *Shape     `RyeField:"14"`
+	Depth   *int16     `RyeField:"15"`
+	cache   string
+}
+
+// Validate is called by the generated Unmarshal.
+func (s *Shape) Validate() error {
+	if len(s.Holes) > len(s.Path) && len(s.Path) > 100 {
+		return errors.New("more holes than points")
+	}
+	return nil
+}
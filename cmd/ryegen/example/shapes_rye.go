@@ -0,0 +1,545 @@
+// Code generated by ryegen from shapes.go. DO NOT EDIT.
+
+package example
+
+import (
+	"github.com/adamcolton/rye"
+	"github.com/adamcolton/rye/thresher"
+)
+
+var ryegenPointHeaders = []uint64{12, 20}
+
+// MarshalSize returns the number of bytes Marshal will write.
+func (v *Point) MarshalSize() int {
+	n := 1
+	{
+		n += 1
+		n += 8
+	}
+	{
+		n += 1
+		n += 8
+	}
+	return n
+}
+
+// Marshal writes v in the format thresher uses for a struct.
+func (v *Point) Marshal(s *rye.Serializer) error {
+	{
+		s.CompactUint64(12)
+		s.Float64(v.X)
+	}
+	{
+		s.CompactUint64(20)
+		s.Float64(v.Y)
+	}
+	s.CompactUint64(0)
+	return nil
+}
+
+var ryegenPointRequired = []string{"X"}
+
+// Unmarshal reads the fields of v up to the end of the struct.
+func (v *Point) Unmarshal(d *rye.Deserializer) error {
+	var seen uint64
+	for {
+		switch h := d.CompactUint64(); h {
+		case 0:
+			if seen != 0x1 {
+				return thresher.MissingFields(ryegenPointRequired, seen)
+			}
+			return thresher.Validate(v)
+		case 12:
+			v.X = d.Float64()
+			seen |= 0x1
+		case 20:
+			v.Y = d.Float64()
+		default:
+			if err := thresher.SkipField("example.Point", ryegenPointHeaders, h, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RyeZero reports whether every field of v that is encoded is zero.
+func (v *Point) RyeZero() bool {
+	return v.X == 0 &&
+		v.Y == 0
+}
+
+var ryegenMetaHeaders = []uint64{13, 21}
+
+// MarshalSize returns the number of bytes Marshal will write.
+func (v *Meta) MarshalSize() int {
+	n := 1
+	if v.Name != "unnamed" {
+		n += 1
+		n += rye.CompactUint64Size(uint64(len(v.Name))) + len(v.Name)
+	}
+	{
+		n += 1
+		{
+			n1 := rye.CompactUint64Size(uint64(len(v.Tags)))
+			for i2 := range v.Tags {
+				n1 += rye.CompactUint64Size(uint64(len(v.Tags[i2]))) + len(v.Tags[i2])
+			}
+			n += rye.CompactUint64Size(uint64(n1)) + n1
+		}
+	}
+	return n
+}
+
+// Marshal writes v in the format thresher uses for a struct.
+func (v *Meta) Marshal(s *rye.Serializer) error {
+	if v.Name != "unnamed" {
+		s.CompactUint64(13)
+		s.CompactString(v.Name)
+	}
+	{
+		s.CompactUint64(21)
+		{
+			n1 := rye.CompactUint64Size(uint64(len(v.Tags)))
+			for i2 := range v.Tags {
+				n1 += rye.CompactUint64Size(uint64(len(v.Tags[i2]))) + len(v.Tags[i2])
+			}
+			s.CompactUint64(uint64(n1))
+			s.CompactUint64(uint64(len(v.Tags)))
+			for i3 := range v.Tags {
+				s.CompactString(v.Tags[i3])
+			}
+		}
+	}
+	s.CompactUint64(0)
+	return nil
+}
+
+// Unmarshal reads the fields of v up to the end of the struct.
+func (v *Meta) Unmarshal(d *rye.Deserializer) error {
+	v.Name = "unnamed"
+	for {
+		switch h := d.CompactUint64(); h {
+		case 0:
+			return thresher.Validate(v)
+		case 13:
+			v.Name = d.CompactString()
+		case 21:
+			{
+				n1, err := thresher.SliceLen(d)
+				if err != nil {
+					return err
+				}
+				v.Tags = nil
+				if n1 > 0 {
+					v.Tags = make([]string, n1)
+				}
+				for i2 := range v.Tags {
+					v.Tags[i2] = d.CompactString()
+				}
+			}
+		default:
+			if err := thresher.SkipField("example.Meta", ryegenMetaHeaders, h, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RyeZero reports whether every field of v that is encoded is zero.
+func (v *Meta) RyeZero() bool {
+	return len(v.Name) == 0 &&
+		len(v.Tags) == 0
+}
+
+var ryegenShapeHeaders = []uint64{13, 21, 25, 33, 46, 53, 62, 69, 75, 80, 88, 101, 109, 118, 120}
+
+// MarshalSize returns the number of bytes Marshal will write.
+func (v *Shape) MarshalSize() int {
+	n := 1
+	if v.Meta.Name != "unnamed" {
+		n += 1
+		n += rye.CompactUint64Size(uint64(len(v.Meta.Name))) + len(v.Meta.Name)
+	}
+	{
+		n += 1
+		{
+			n1 := rye.CompactUint64Size(uint64(len(v.Meta.Tags)))
+			for i2 := range v.Meta.Tags {
+				n1 += rye.CompactUint64Size(uint64(len(v.Meta.Tags[i2]))) + len(v.Meta.Tags[i2])
+			}
+			n += rye.CompactUint64Size(uint64(n1)) + n1
+		}
+	}
+	{
+		n += 1
+		n += 1
+	}
+	if v.Color != 0 {
+		n += 1
+		n += 1
+	}
+	{
+		n += 1
+		n += v.Origin.MarshalSize()
+	}
+	if len(v.Path) != 0 {
+		n += 1
+		{
+			n3 := rye.CompactUint64Size(uint64(len(v.Path)))
+			for i4 := range v.Path {
+				n3 += v.Path[i4].MarshalSize()
+			}
+			n += rye.CompactUint64Size(uint64(n3)) + n3
+		}
+	}
+	if v.Anchor != nil {
+		n += 1
+		n += v.Anchor.MarshalSize()
+	}
+	if len(v.Holes) != 0 {
+		n += 1
+		{
+			n5 := rye.CompactUint64Size(uint64(len(v.Holes)))
+			for i6 := range v.Holes {
+				{
+					n7 := rye.CompactUint64Size(uint64(len(v.Holes[i6])))
+					for i8 := range v.Holes[i6] {
+						n7++
+						if v.Holes[i6][i8] != nil {
+							n7 += v.Holes[i6][i8].MarshalSize()
+						}
+					}
+					n5 += rye.CompactUint64Size(uint64(n7)) + n7
+				}
+			}
+			n += rye.CompactUint64Size(uint64(n5)) + n5
+		}
+	}
+	if v.Scale != 1.5 {
+		n += 1
+		n += 4
+	}
+	{
+		n += 1
+		n += rye.CompactUint64Size(v.ID)
+	}
+	if v.Delta != -1 {
+		n += 1
+		n += rye.CompactInt64Size(int64(v.Delta))
+	}
+	if len(v.Data) != 0 {
+		n += 1
+		n += rye.CompactUint64Size(uint64(len(v.Data))) + len(v.Data)
+	}
+	if len(v.Weights) != 0 {
+		n += 1
+		{
+			n9 := rye.CompactUint64Size(uint64(len(v.Weights)))
+			for i10 := range v.Weights {
+				n9 += rye.CompactInt64Size(int64(v.Weights[i10]))
+			}
+			n += rye.CompactUint64Size(uint64(n9)) + n9
+		}
+	}
+	if v.Next != nil {
+		n += 1
+		n += v.Next.MarshalSize()
+	}
+	if v.Depth != nil {
+		n += 1
+		n += rye.CompactInt64Size(int64(*v.Depth))
+	}
+	return n
+}
+
+// Marshal writes v in the format thresher uses for a struct.
+func (v *Shape) Marshal(s *rye.Serializer) error {
+	if v.Meta.Name != "unnamed" {
+		s.CompactUint64(13)
+		s.CompactString(v.Meta.Name)
+	}
+	{
+		s.CompactUint64(21)
+		{
+			n1 := rye.CompactUint64Size(uint64(len(v.Meta.Tags)))
+			for i2 := range v.Meta.Tags {
+				n1 += rye.CompactUint64Size(uint64(len(v.Meta.Tags[i2]))) + len(v.Meta.Tags[i2])
+			}
+			s.CompactUint64(uint64(n1))
+			s.CompactUint64(uint64(len(v.Meta.Tags)))
+			for i3 := range v.Meta.Tags {
+				s.CompactString(v.Meta.Tags[i3])
+			}
+		}
+	}
+	{
+		s.CompactUint64(25)
+		s.Int8(v.Kind)
+	}
+	if v.Color != 0 {
+		s.CompactUint64(33)
+		s.Byte(byte(v.Color))
+	}
+	{
+		s.CompactUint64(46)
+		if err := v.Origin.Marshal(s); err != nil {
+			return err
+		}
+	}
+	if len(v.Path) != 0 {
+		s.CompactUint64(53)
+		{
+			n4 := rye.CompactUint64Size(uint64(len(v.Path)))
+			for i5 := range v.Path {
+				n4 += v.Path[i5].MarshalSize()
+			}
+			s.CompactUint64(uint64(n4))
+			s.CompactUint64(uint64(len(v.Path)))
+			for i6 := range v.Path {
+				if err := v.Path[i6].Marshal(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if v.Anchor != nil {
+		s.CompactUint64(62)
+		if err := v.Anchor.Marshal(s); err != nil {
+			return err
+		}
+	}
+	if len(v.Holes) != 0 {
+		s.CompactUint64(69)
+		{
+			n7 := rye.CompactUint64Size(uint64(len(v.Holes)))
+			for i8 := range v.Holes {
+				{
+					n9 := rye.CompactUint64Size(uint64(len(v.Holes[i8])))
+					for i10 := range v.Holes[i8] {
+						n9++
+						if v.Holes[i8][i10] != nil {
+							n9 += v.Holes[i8][i10].MarshalSize()
+						}
+					}
+					n7 += rye.CompactUint64Size(uint64(n9)) + n9
+				}
+			}
+			s.CompactUint64(uint64(n7))
+			s.CompactUint64(uint64(len(v.Holes)))
+			for i11 := range v.Holes {
+				{
+					n12 := rye.CompactUint64Size(uint64(len(v.Holes[i11])))
+					for i13 := range v.Holes[i11] {
+						n12++
+						if v.Holes[i11][i13] != nil {
+							n12 += v.Holes[i11][i13].MarshalSize()
+						}
+					}
+					s.CompactUint64(uint64(n12))
+					s.CompactUint64(uint64(len(v.Holes[i11])))
+					for i14 := range v.Holes[i11] {
+						if v.Holes[i11][i14] == nil {
+							s.Byte(0)
+						} else {
+							s.Byte(1)
+							if err := v.Holes[i11][i14].Marshal(s); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if v.Scale != 1.5 {
+		s.CompactUint64(75)
+		s.Float32(v.Scale)
+	}
+	{
+		s.CompactUint64(80)
+		s.CompactUint64(v.ID)
+	}
+	if v.Delta != -1 {
+		s.CompactUint64(88)
+		s.CompactInt64(int64(v.Delta))
+	}
+	if len(v.Data) != 0 {
+		s.CompactUint64(101)
+		s.CompactSlice(v.Data)
+	}
+	if len(v.Weights) != 0 {
+		s.CompactUint64(109)
+		{
+			n15 := rye.CompactUint64Size(uint64(len(v.Weights)))
+			for i16 := range v.Weights {
+				n15 += rye.CompactInt64Size(int64(v.Weights[i16]))
+			}
+			s.CompactUint64(uint64(n15))
+			s.CompactUint64(uint64(len(v.Weights)))
+			for i17 := range v.Weights {
+				s.CompactInt64(int64(v.Weights[i17]))
+			}
+		}
+	}
+	if v.Next != nil {
+		s.CompactUint64(118)
+		if err := v.Next.Marshal(s); err != nil {
+			return err
+		}
+	}
+	if v.Depth != nil {
+		s.CompactUint64(120)
+		s.CompactInt64(int64(*v.Depth))
+	}
+	s.CompactUint64(0)
+	return nil
+}
+
+var ryegenShapeRequired = []string{"ID"}
+
+// Unmarshal reads the fields of v up to the end of the struct.
+func (v *Shape) Unmarshal(d *rye.Deserializer) error {
+	v.Meta.Name = "unnamed"
+	v.Scale = 1.5
+	v.Delta = -1
+	var seen uint64
+	for {
+		switch h := d.CompactUint64(); h {
+		case 0:
+			if seen != 0x1 {
+				return thresher.MissingFields(ryegenShapeRequired, seen)
+			}
+			return thresher.Validate(v)
+		case 13:
+			v.Meta.Name = d.CompactString()
+		case 21:
+			{
+				n1, err := thresher.SliceLen(d)
+				if err != nil {
+					return err
+				}
+				v.Meta.Tags = nil
+				if n1 > 0 {
+					v.Meta.Tags = make([]string, n1)
+				}
+				for i2 := range v.Meta.Tags {
+					v.Meta.Tags[i2] = d.CompactString()
+				}
+			}
+		case 25:
+			v.Kind = d.Int8()
+		case 33:
+			v.Color = Color(d.Byte())
+		case 46:
+			if err := v.Origin.Unmarshal(d); err != nil {
+				return thresher.WithField(err, "Origin")
+			}
+		case 53:
+			{
+				n3, err := thresher.SliceLen(d)
+				if err != nil {
+					return err
+				}
+				v.Path = nil
+				if n3 > 0 {
+					v.Path = make([]Point, n3)
+				}
+				for i4 := range v.Path {
+					if err := v.Path[i4].Unmarshal(d); err != nil {
+						return thresher.WithField(thresher.WithIndex(err, i4), "Path")
+					}
+				}
+			}
+		case 62:
+			v.Anchor = new(Point)
+			if err := v.Anchor.Unmarshal(d); err != nil {
+				return thresher.WithField(err, "Anchor")
+			}
+		case 69:
+			{
+				n5, err := thresher.SliceLen(d)
+				if err != nil {
+					return err
+				}
+				v.Holes = nil
+				if n5 > 0 {
+					v.Holes = make([][]*Point, n5)
+				}
+				for i6 := range v.Holes {
+					{
+						n7, err := thresher.SliceLen(d)
+						if err != nil {
+							return err
+						}
+						v.Holes[i6] = nil
+						if n7 > 0 {
+							v.Holes[i6] = make([]*Point, n7)
+						}
+						for i8 := range v.Holes[i6] {
+							if d.Byte() != 0 {
+								v.Holes[i6][i8] = new(Point)
+								if err := v.Holes[i6][i8].Unmarshal(d); err != nil {
+									return thresher.WithField(thresher.WithIndex(thresher.WithIndex(err, i8), i6), "Holes")
+								}
+							}
+						}
+					}
+				}
+			}
+		case 75:
+			v.Scale = d.Float32()
+		case 80:
+			v.ID = d.CompactUint64()
+			seen |= 0x1
+		case 88:
+			v.Delta = int(d.CompactInt64())
+		case 101:
+			v.Data = append([]byte(nil), d.CompactSlice()...)
+		case 109:
+			{
+				n9, err := thresher.SliceLen(d)
+				if err != nil {
+					return err
+				}
+				v.Weights = nil
+				if n9 > 0 {
+					v.Weights = make([]int32, n9)
+				}
+				for i10 := range v.Weights {
+					v.Weights[i10] = int32(d.CompactInt64())
+				}
+			}
+		case 118:
+			v.Next = new(Shape)
+			if err := v.Next.Unmarshal(d); err != nil {
+				return thresher.WithField(err, "Next")
+			}
+		case 120:
+			v.Depth = new(int16)
+			*v.Depth = int16(d.CompactInt64())
+		default:
+			if err := thresher.SkipField("example.Shape", ryegenShapeHeaders, h, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RyeZero reports whether every field of v that is encoded is zero.
+func (v *Shape) RyeZero() bool {
+	return len(v.Meta.Name) == 0 &&
+		len(v.Meta.Tags) == 0 &&
+		v.Kind == 0 &&
+		v.Color == 0 &&
+		v.Origin.RyeZero() &&
+		len(v.Path) == 0 &&
+		v.Anchor == nil &&
+		len(v.Holes) == 0 &&
+		v.Scale == 0 &&
+		v.ID == 0 &&
+		v.Delta == 0 &&
+		len(v.Data) == 0 &&
+		len(v.Weights) == 0 &&
+		v.Next == nil &&
+		v.Depth == nil
+}
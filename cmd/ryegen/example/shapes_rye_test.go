@@ -0,0 +1,242 @@
+// Code generated by ryegen from shapes.go. DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/adamcolton/rye"
+	"github.com/adamcolton/rye/thresher"
+)
+
+func TestRyegenPoint(t *testing.T) {
+	reflection := &thresher.Thresher{IgnoreGenerated: true}
+	generated := &thresher.Thresher{}
+	for _, th := range []*thresher.Thresher{reflection, generated} {
+		if err := th.RegisterNamed("example.Point", (*Point)(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		v := new(Point)
+		ryegenFillPoint(v, r, 0)
+		want, err := reflection.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := generated.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("generated Marshal differs from reflection\nwant %x\ngot  %x", want, got)
+		}
+		raw, err := rye.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(Point)
+		if err := out.Unmarshal(rye.NewDeserializer(raw)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = reflection.Marshal(out, nil); !bytes.Equal(want, got) {
+			t.Fatalf("generated Unmarshal did not decode the same value\nwant %x\ngot  %x", want, got)
+		}
+	}
+}
+
+// ryegenFillPoint sets random values, including zero and default values, on the fields of v.
+func ryegenFillPoint(v *Point, r *rand.Rand, depth int) {
+	if depth > 3 {
+		return
+	}
+	if r.Intn(3) != 0 {
+		v.X = float64(r.NormFloat64())
+	}
+	if r.Intn(3) != 0 {
+		v.Y = float64(r.NormFloat64())
+	}
+}
+
+func TestRyegenMeta(t *testing.T) {
+	reflection := &thresher.Thresher{IgnoreGenerated: true}
+	generated := &thresher.Thresher{}
+	for _, th := range []*thresher.Thresher{reflection, generated} {
+		if err := th.RegisterNamed("example.Meta", (*Meta)(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		v := new(Meta)
+		ryegenFillMeta(v, r, 0)
+		want, err := reflection.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := generated.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("generated Marshal differs from reflection\nwant %x\ngot  %x", want, got)
+		}
+		raw, err := rye.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(Meta)
+		if err := out.Unmarshal(rye.NewDeserializer(raw)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = reflection.Marshal(out, nil); !bytes.Equal(want, got) {
+			t.Fatalf("generated Unmarshal did not decode the same value\nwant %x\ngot  %x", want, got)
+		}
+	}
+}
+
+// ryegenFillMeta sets random values, including zero and default values, on the fields of v.
+func ryegenFillMeta(v *Meta, r *rand.Rand, depth int) {
+	if depth > 3 {
+		return
+	}
+	if r.Intn(4) == 0 {
+		v.Name = "unnamed"
+	} else if r.Intn(3) != 0 {
+		b1 := make([]byte, 1+r.Intn(8))
+		r.Read(b1)
+		v.Name = string(b1)
+	}
+	if r.Intn(3) != 0 {
+		v.Tags = make([]string, 1+r.Intn(3))
+		for i2 := range v.Tags {
+			b3 := make([]byte, 1+r.Intn(8))
+			r.Read(b3)
+			v.Tags[i2] = string(b3)
+		}
+	}
+}
+
+func TestRyegenShape(t *testing.T) {
+	reflection := &thresher.Thresher{IgnoreGenerated: true}
+	generated := &thresher.Thresher{}
+	for _, th := range []*thresher.Thresher{reflection, generated} {
+		if err := th.RegisterNamed("example.Shape", (*Shape)(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		v := new(Shape)
+		ryegenFillShape(v, r, 0)
+		want, err := reflection.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := generated.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("generated Marshal differs from reflection\nwant %x\ngot  %x", want, got)
+		}
+		raw, err := rye.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(Shape)
+		if err := out.Unmarshal(rye.NewDeserializer(raw)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = reflection.Marshal(out, nil); !bytes.Equal(want, got) {
+			t.Fatalf("generated Unmarshal did not decode the same value\nwant %x\ngot  %x", want, got)
+		}
+	}
+}
+
+// ryegenFillShape sets random values, including zero and default values, on the fields of v.
+func ryegenFillShape(v *Shape, r *rand.Rand, depth int) {
+	if depth > 3 {
+		return
+	}
+	if r.Intn(4) == 0 {
+		v.Meta.Name = "unnamed"
+	} else if r.Intn(3) != 0 {
+		b1 := make([]byte, 1+r.Intn(8))
+		r.Read(b1)
+		v.Meta.Name = string(b1)
+	}
+	if r.Intn(3) != 0 {
+		v.Meta.Tags = make([]string, 1+r.Intn(3))
+		for i2 := range v.Meta.Tags {
+			b3 := make([]byte, 1+r.Intn(8))
+			r.Read(b3)
+			v.Meta.Tags[i2] = string(b3)
+		}
+	}
+	if r.Intn(3) != 0 {
+		v.Kind = int8(r.Uint64())
+	}
+	if r.Intn(3) != 0 {
+		v.Color = Color(r.Uint64())
+	}
+	if r.Intn(3) != 0 {
+		ryegenFillPoint(&v.Origin, r, depth+1)
+	}
+	if r.Intn(3) != 0 {
+		v.Path = make([]Point, 1+r.Intn(3))
+		for i4 := range v.Path {
+			ryegenFillPoint(&v.Path[i4], r, depth+1)
+		}
+	}
+	if r.Intn(3) != 0 {
+		v.Anchor = new(Point)
+		ryegenFillPoint(v.Anchor, r, depth+1)
+	}
+	if r.Intn(3) != 0 {
+		v.Holes = make([][]*Point, 1+r.Intn(3))
+		for i5 := range v.Holes {
+			v.Holes[i5] = make([]*Point, 1+r.Intn(3))
+			for i6 := range v.Holes[i5] {
+				if r.Intn(4) != 0 {
+					v.Holes[i5][i6] = new(Point)
+					ryegenFillPoint(v.Holes[i5][i6], r, depth+1)
+				}
+			}
+		}
+	}
+	if r.Intn(4) == 0 {
+		v.Scale = 1.5
+	} else if r.Intn(3) != 0 {
+		v.Scale = float32(r.NormFloat64())
+	}
+	if r.Intn(3) != 0 {
+		v.ID = uint64(r.Uint64())
+	}
+	if r.Intn(4) == 0 {
+		v.Delta = -1
+	} else if r.Intn(3) != 0 {
+		v.Delta = int(r.Uint64())
+	}
+	if r.Intn(3) != 0 {
+		v.Data = make([]byte, 1+r.Intn(8))
+		r.Read(v.Data)
+	}
+	if r.Intn(3) != 0 {
+		v.Weights = make([]int32, 1+r.Intn(3))
+		for i7 := range v.Weights {
+			v.Weights[i7] = int32(r.Uint64())
+		}
+	}
+	if r.Intn(3) != 0 {
+		v.Next = new(Shape)
+		ryegenFillShape(v.Next, r, depth+1)
+	}
+	if r.Intn(3) != 0 {
+		v.Depth = new(int16)
+		*v.Depth = int16(r.Uint64())
+	}
+}
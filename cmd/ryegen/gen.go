@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+
+	"github.com/adamcolton/rye"
+)
+
+type generator struct {
+	buf bytes.Buffer
+	// vars numbers the temporary variables in a function.
+	vars int
+	// field and index are the name of the field being decoded and the index
+	// variables of the slices around the current value, for the path of an
+	// error.
+	field string
+	index []string
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// tmp returns a new variable name.
+func (g *generator) tmp(prefix string) string {
+	g.vars++
+	return fmt.Sprintf("%s%d", prefix, g.vars)
+}
+
+// source formats the generated code.
+func (g *generator) source() ([]byte, error) {
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("ryegen: generated invalid code: %w", err)
+	}
+	return out, nil
+}
+
+// generate writes the methods for every struct in f.
+func generate(f *file, source string) ([]byte, error) {
+	g := &generator{}
+	g.printf("// Code generated by ryegen from %s. DO NOT EDIT.\n\n", source)
+	g.printf("package %s\n\n", f.pkg)
+	g.printf("import (\n\"github.com/adamcolton/rye\"\n\"github.com/adamcolton/rye/thresher\"\n)\n")
+	for _, st := range f.structs {
+		g.methods(f.pkg, st)
+	}
+	return g.source()
+}
+
+func (g *generator) methods(pkg string, st *structType) {
+	headers := "ryegen" + st.name + "Headers"
+	g.printf("\nvar %s = []uint64{", headers)
+	for i, f := range st.fields {
+		if i > 0 {
+			g.printf(", ")
+		}
+		g.printf("%d", f.header())
+	}
+	g.printf("}\n")
+
+	g.vars = 0
+	g.printf("\n// MarshalSize returns the number of bytes Marshal will write.\n")
+	g.printf("func (v *%s) MarshalSize() int {\nn := 1\n", st.name)
+	for _, f := range st.fields {
+		x := "v." + f.path
+		g.ifWritten(f, x)
+		g.printf("n += %d\n", rye.CompactUint64Size(f.header()))
+		g.size("n", f.t, x)
+		g.printf("}\n")
+	}
+	g.printf("return n\n}\n")
+
+	g.vars = 0
+	g.printf("\n// Marshal writes v in the format thresher uses for a struct.\n")
+	g.printf("func (v *%s) Marshal(s *rye.Serializer) error {\n", st.name)
+	for _, f := range st.fields {
+		x := "v." + f.path
+		g.ifWritten(f, x)
+		g.printf("s.CompactUint64(%d)\n", f.header())
+		g.marshal(f.t, x)
+		g.printf("}\n")
+	}
+	g.printf("s.CompactUint64(0)\nreturn nil\n}\n")
+
+	var required []string
+	for _, f := range st.fields {
+		if f.required {
+			required = append(required, strconv.Quote(f.name))
+		}
+	}
+	if len(required) > 0 {
+		g.printf("\nvar ryegen%sRequired = []string{%s}\n", st.name, strings.Join(required, ", "))
+	}
+
+	g.vars = 0
+	g.printf("\n// Unmarshal reads the fields of v up to the end of the struct.\n")
+	g.printf("func (v *%s) Unmarshal(d *rye.Deserializer) error {\n", st.name)
+	for _, f := range st.fields {
+		if f.dflt != "" {
+			g.printf("v.%s = %s\n", f.path, f.dflt)
+		}
+	}
+	if len(required) > 0 {
+		g.printf("var seen uint64\n")
+	}
+	g.printf("for {\nswitch h := d.CompactUint64(); h {\ncase 0:\n")
+	if len(required) > 0 {
+		g.printf("if seen != %#x {\nreturn thresher.MissingFields(ryegen%sRequired, seen)\n}\n", uint64(1)<<len(required)-1, st.name)
+	}
+	g.printf("return thresher.Validate(v)\n")
+	var bit int
+	for _, f := range st.fields {
+		g.printf("case %d:\n", f.header())
+		g.field = f.name
+		g.unmarshal(f.t, "v."+f.path, true)
+		if f.required {
+			g.printf("seen |= %#x\n", uint64(1)<<bit)
+			bit++
+		}
+	}
+	g.printf("default:\nif err := thresher.SkipField(%q, %s, h, d); err != nil {\nreturn err\n}\n", pkg+"."+st.name, headers)
+	g.printf("}\n}\n}\n")
+
+	g.printf("\n// RyeZero reports whether every field of v that is encoded is zero.\n")
+	g.printf("func (v *%s) RyeZero() bool {\n", st.name)
+	if len(st.fields) == 0 {
+		g.printf("return true\n}\n")
+		return
+	}
+	g.printf("return ")
+	for i, f := range st.fields {
+		if i > 0 {
+			g.printf(" &&\n")
+		}
+		g.printf("%s", zero(f.t, "v."+f.path))
+	}
+	g.printf("\n}\n")
+}
+
+// ifWritten opens the block that writes the field x. A field with the always
+// option is written even if it is zero so the block is unconditional; a field
+// with a default is written if it is not equal to it.
+func (g *generator) ifWritten(f field, x string) {
+	switch {
+	case f.always:
+		g.printf("{\n")
+	case f.dflt != "":
+		g.printf("if %s != %s {\n", x, f.dflt)
+	default:
+		g.printf("if %s {\n", nonZero(f.t, x))
+	}
+}
+
+// conv converts x, of type t, to the type to.
+func conv(to string, t *goType, x string) string {
+	if t.expr == to {
+		return x
+	}
+	return to + "(" + x + ")"
+}
+
+// deref dereferences x, a pointer of type t. Methods of a struct are called on
+// the pointer itself.
+func deref(t *goType, x string) string {
+	if t.elem.kind == kindStruct {
+		return x
+	}
+	return "*" + x
+}
+
+// index is the expression for element i of the slice x.
+func index(x, i string) string {
+	if strings.HasPrefix(x, "*") {
+		x = "(" + x + ")"
+	}
+	return x + "[" + i + "]"
+}
+
+func zero(t *goType, x string) string {
+	switch t.kind {
+	case kindString, kindBytes, kindSlice:
+		return "len(" + x + ") == 0"
+	case kindPtr:
+		return x + " == nil"
+	case kindStruct:
+		return x + ".RyeZero()"
+	}
+	return x + " == 0"
+}
+
+func nonZero(t *goType, x string) string {
+	switch t.kind {
+	case kindString, kindBytes, kindSlice:
+		return "len(" + x + ") != 0"
+	case kindPtr:
+		return x + " != nil"
+	case kindStruct:
+		return "!" + x + ".RyeZero()"
+	}
+	return x + " != 0"
+}
+
+// fixedSize is the size of a value of type t if it is always the same.
+func fixedSize(t *goType) int {
+	switch t.kind {
+	case kindInt8, kindUint8:
+		return 1
+	case kindFloat32:
+		return 4
+	case kindFloat64:
+		return 8
+	}
+	return 0
+}
+
+// size adds the size of x to the variable acc. A pointer that is not a struct
+// field is prefixed with a presence byte.
+func (g *generator) size(acc string, t *goType, x string) {
+	switch t.kind {
+	case kindInt:
+		g.printf("%s += rye.CompactInt64Size(%s)\n", acc, conv("int64", t, x))
+	case kindUint:
+		g.printf("%s += rye.CompactUint64Size(%s)\n", acc, conv("uint64", t, x))
+	case kindInt8, kindUint8, kindFloat32, kindFloat64:
+		g.printf("%s += %d\n", acc, fixedSize(t))
+	case kindString, kindBytes:
+		g.printf("%s += rye.CompactUint64Size(uint64(len(%s))) + len(%s)\n", acc, x, x)
+	case kindStruct:
+		g.printf("%s += %s.MarshalSize()\n", acc, x)
+	case kindPtr:
+		g.size(acc, t.elem, deref(t, x))
+	case kindSlice:
+		n := g.sliceSize(t, x)
+		g.printf("%s += rye.CompactUint64Size(uint64(%s)) + %s\n}\n", acc, n, n)
+	}
+}
+
+// elemSize is size for a value that is not a struct field.
+func (g *generator) elemSize(acc string, t *goType, x string) {
+	if t.kind != kindPtr {
+		g.size(acc, t, x)
+		return
+	}
+	g.printf("%s++\nif %s != nil {\n", acc, x)
+	g.elemSize(acc, t.elem, deref(t, x))
+	g.printf("}\n")
+}
+
+// sliceSize opens a block and declares a variable holding the size of the
+// slice x without its length prefix. The caller closes the block.
+func (g *generator) sliceSize(t *goType, x string) string {
+	n := g.tmp("n")
+	g.printf("{\n%s := rye.CompactUint64Size(uint64(len(%s)))\n", n, x)
+	if size := fixedSize(t.elem); size > 0 {
+		g.printf("%s += %d * len(%s)\n", n, size, x)
+		return n
+	}
+	i := g.tmp("i")
+	g.printf("for %s := range %s {\n", i, x)
+	g.elemSize(n, t.elem, index(x, i))
+	g.printf("}\n")
+	return n
+}
+
+func (g *generator) marshal(t *goType, x string) {
+	switch t.kind {
+	case kindInt:
+		g.printf("s.CompactInt64(%s)\n", conv("int64", t, x))
+	case kindUint:
+		g.printf("s.CompactUint64(%s)\n", conv("uint64", t, x))
+	case kindInt8:
+		g.printf("s.Int8(%s)\n", conv("int8", t, x))
+	case kindUint8:
+		g.printf("s.Byte(%s)\n", conv("byte", t, x))
+	case kindFloat32:
+		g.printf("s.Float32(%s)\n", conv("float32", t, x))
+	case kindFloat64:
+		g.printf("s.Float64(%s)\n", conv("float64", t, x))
+	case kindString:
+		g.printf("s.CompactString(%s)\n", conv("string", t, x))
+	case kindBytes:
+		g.printf("s.CompactSlice(%s)\n", x)
+	case kindStruct:
+		g.printf("if err := %s.Marshal(s); err != nil {\nreturn err\n}\n", x)
+	case kindPtr:
+		g.marshal(t.elem, deref(t, x))
+	case kindSlice:
+		n := g.sliceSize(t, x)
+		i := g.tmp("i")
+		g.printf("s.CompactUint64(uint64(%s))\ns.CompactUint64(uint64(len(%s)))\n", n, x)
+		g.printf("for %s := range %s {\n", i, x)
+		g.marshalElem(t.elem, index(x, i))
+		g.printf("}\n}\n")
+	}
+}
+
+// marshalElem is marshal for a value that is not a struct field.
+func (g *generator) marshalElem(t *goType, x string) {
+	if t.kind != kindPtr {
+		g.marshal(t, x)
+		return
+	}
+	g.printf("if %s == nil {\ns.Byte(0)\n} else {\ns.Byte(1)\n", x)
+	g.marshalElem(t.elem, deref(t, x))
+	g.printf("}\n")
+}
+
+// unmarshal decodes into x. field is true if x is a struct field, in which
+// case a pointer does not have a presence byte.
+func (g *generator) unmarshal(t *goType, x string, field bool) {
+	switch t.kind {
+	case kindInt:
+		g.printf("%s = %s\n", x, convFrom("int64", t, "d.CompactInt64()"))
+	case kindUint:
+		g.printf("%s = %s\n", x, convFrom("uint64", t, "d.CompactUint64()"))
+	case kindInt8:
+		g.printf("%s = %s\n", x, convFrom("int8", t, "d.Int8()"))
+	case kindUint8:
+		g.printf("%s = %s\n", x, convFrom("byte", t, "d.Byte()"))
+	case kindFloat32:
+		g.printf("%s = %s\n", x, convFrom("float32", t, "d.Float32()"))
+	case kindFloat64:
+		g.printf("%s = %s\n", x, convFrom("float64", t, "d.Float64()"))
+	case kindString:
+		g.printf("%s = %s\n", x, convFrom("string", t, "d.CompactString()"))
+	case kindBytes:
+		g.printf("%s = append(%s(nil), d.CompactSlice()...)\n", x, t.expr)
+	case kindStruct:
+		g.printf("if err := %s.Unmarshal(d); err != nil {\nreturn %s\n}\n", x, g.errPath())
+	case kindPtr:
+		if field {
+			g.printf("%s = new(%s)\n", x, t.elem.expr)
+			g.unmarshal(t.elem, deref(t, x), false)
+			return
+		}
+		g.printf("if d.Byte() != 0 {\n%s = new(%s)\n", x, t.elem.expr)
+		g.unmarshal(t.elem, deref(t, x), false)
+		g.printf("}\n")
+	case kindSlice:
+		n, i := g.tmp("n"), g.tmp("i")
+		g.printf("{\n%s, err := thresher.SliceLen(d)\nif err != nil {\nreturn err\n}\n", n)
+		// an empty slice is decoded as nil, as it is by reflection
+		g.printf("%s = nil\nif %s > 0 {\n%s = make(%s, %s)\n}\n", x, n, x, t.expr, n)
+		g.printf("for %s := range %s {\n", i, x)
+		g.index = append(g.index, i)
+		g.unmarshal(t.elem, index(x, i), false)
+		g.index = g.index[:len(g.index)-1]
+		g.printf("}\n}\n")
+	}
+}
+
+// errPath adds the path of the value being decoded to err.
+func (g *generator) errPath() string {
+	e := "err"
+	for i := len(g.index) - 1; i >= 0; i-- {
+		e = fmt.Sprintf("thresher.WithIndex(%s, %s)", e, g.index[i])
+	}
+	return fmt.Sprintf("thresher.WithField(%s, %q)", e, g.field)
+}
+
+// convFrom converts x, of the type from, to t.
+func convFrom(from string, t *goType, x string) string {
+	if t.expr == from || (from == "byte" && t.expr == "uint8") {
+		return x
+	}
+	return t.expr + "(" + x + ")"
+}
+
+// generateTest writes a test for every struct in f that checks the generated
+// methods write the same bytes as thresher does by reflection for random
+// values and that the generated Unmarshal reads back the same value.
+func generateTest(f *file, source string) ([]byte, error) {
+	g := &generator{}
+	g.printf("// Code generated by ryegen from %s. DO NOT EDIT.\n\n", source)
+	g.printf("package %s\n\n", f.pkg)
+	g.printf("import (\n\"bytes\"\n\"math/rand\"\n\"testing\"\n\n\"github.com/adamcolton/rye\"\n\"github.com/adamcolton/rye/thresher\"\n)\n")
+	for _, st := range f.structs {
+		g.test(f.pkg, st)
+	}
+	return g.source()
+}
+
+func (g *generator) test(pkg string, st *structType) {
+	g.printf(`
+func TestRyegen%[1]s(t *testing.T) {
+	reflection := &thresher.Thresher{IgnoreGenerated: true}
+	generated := &thresher.Thresher{}
+	for _, th := range []*thresher.Thresher{reflection, generated} {
+		if err := th.RegisterNamed(%[2]q, (*%[1]s)(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		v := new(%[1]s)
+		ryegenFill%[1]s(v, r, 0)
+		want, err := reflection.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := generated.Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("generated Marshal differs from reflection\nwant %%x\ngot  %%x", want, got)
+		}
+		raw, err := rye.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(%[1]s)
+		if err := out.Unmarshal(rye.NewDeserializer(raw)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = reflection.Marshal(out, nil); !bytes.Equal(want, got) {
+			t.Fatalf("generated Unmarshal did not decode the same value\nwant %%x\ngot  %%x", want, got)
+		}
+	}
+}
+`, st.name, pkg+"."+st.name)
+
+	g.vars = 0
+	g.printf("\n// ryegenFill%s sets random values, including zero and default values, on the fields of v.\n", st.name)
+	g.printf("func ryegenFill%s(v *%s, r *rand.Rand, depth int) {\nif depth > 3 {\nreturn\n}\n", st.name, st.name)
+	for _, f := range st.fields {
+		if f.dflt != "" {
+			g.printf("if r.Intn(4) == 0 {\nv.%s = %s\n} else ", f.path, f.dflt)
+		}
+		g.printf("if r.Intn(3) != 0 {\n")
+		g.fill(f.t, "v."+f.path, true)
+		g.printf("}\n")
+	}
+	g.printf("}\n")
+}
+
+// fill sets x to a random value that is not zero. Slices that are not struct
+// fields always have at least one element.
+func (g *generator) fill(t *goType, x string, field bool) {
+	switch t.kind {
+	case kindInt, kindUint, kindInt8, kindUint8:
+		g.printf("%s = %s(r.Uint64())\n", x, t.expr)
+	case kindFloat32, kindFloat64:
+		g.printf("%s = %s(r.NormFloat64())\n", x, t.expr)
+	case kindString:
+		b := g.tmp("b")
+		g.printf("%s := make([]byte, 1+r.Intn(8))\nr.Read(%s)\n%s = %s(%s)\n", b, b, x, t.expr, b)
+	case kindBytes:
+		g.printf("%s = make(%s, 1+r.Intn(8))\nr.Read(%s)\n", x, t.expr, x)
+	case kindStruct:
+		g.printf("ryegenFill%s(&%s, r, depth+1)\n", t.expr, x)
+	case kindPtr:
+		if !field {
+			g.printf("if r.Intn(4) != 0 {\n")
+		}
+		g.printf("%s = new(%s)\n", x, t.elem.expr)
+		if t.elem.kind == kindStruct {
+			g.printf("ryegenFill%s(%s, r, depth+1)\n", t.elem.expr, x)
+		} else {
+			g.fill(t.elem, "*"+x, false)
+		}
+		if !field {
+			g.printf("}\n")
+		}
+	case kindSlice:
+		i := g.tmp("i")
+		g.printf("%s = make(%s, 1+r.Intn(3))\nfor %s := range %s {\n", x, t.expr, i, x)
+		g.fill(t.elem, index(x, i), false)
+		g.printf("}\n")
+	}
+}
@@ -0,0 +1,83 @@
+// Command ryegen writes MarshalSize, Marshal and Unmarshal methods for structs
+// with RyeField tags. The methods use the same wire format as thresher does
+// by reflection, so they can be added to a type without changing its data,
+// and a thresher.Thresher encodes with them in place of reflection because
+// they also implement thresher.Generated. A Thresher still decodes by
+// reflection so that its Limits apply. The methods can also be used without a
+// Thresher through rye.Marshal and the Unmarshal method.
+//
+// It is intended to be run by go generate:
+//
+//	//go:generate go run github.com/adamcolton/rye/cmd/ryegen -test $GOFILE
+//
+// The methods for the structs in file.go are written to file_rye.go. By
+// default every struct with a RyeField tag is used; -type takes a comma
+// separated list instead. With -test, file_rye_test.go is also written; it
+// checks that the generated methods and reflection write the same bytes for
+// random values and that the generated Unmarshal reads the data back.
+//
+// Fields can be integers other than uintptr, floats, strings, []byte, slices,
+// pointers and other structs in the same file that methods are generated for.
+// Embedded structs tagged `RyeField:",flatten"` are flattened as thresher
+// does; they must also be declared in the same file. Other types, including
+// interfaces and types in the file with their own Marshal method, are an
+// error and must be encoded by reflection. ryegen cannot see methods declared
+// in other files or a Codec registered at run time, so a Thresher checks
+// when a type is registered and encodes a struct by reflection if any field
+// it would reach is encoded by a Codec or its own methods.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeNames := flag.String("type", "", "comma separated list of structs; by default every struct with a RyeField tag")
+	test := flag.Bool("test", false, "also write a test comparing the generated methods with reflection")
+	flag.Parse()
+
+	filename := flag.Arg(0)
+	if filename == "" {
+		filename = os.Getenv("GOFILE")
+	}
+	if filename == "" || flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: ryegen [-type T,U] [-test] file.go")
+		os.Exit(2)
+	}
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+	if err := run(filename, names, *test); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(filename string, names []string, test bool) error {
+	f, err := parseFile(filename, nil, names)
+	if err != nil {
+		return err
+	}
+	source := filepath.Base(filename)
+	base := strings.TrimSuffix(filename, ".go")
+	out, err := generate(f, source)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+"_rye.go", out, 0644); err != nil {
+		return err
+	}
+	if !test {
+		return nil
+	}
+	out, err = generateTest(f, source)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(base+"_rye_test.go", out, 0644)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// kind is how a value is encoded. Each kind matches an op that thresher
+// compiles for the same Go type.
+type kind byte
+
+const (
+	kindInt kind = iota
+	kindUint
+	kindInt8
+	kindUint8
+	kindFloat32
+	kindFloat64
+	kindString
+	kindBytes
+	kindSlice
+	kindPtr
+	kindStruct
+)
+
+// wire types from thresher; they are not exported.
+const (
+	wireVarint  = 0
+	wireFixed8  = 1
+	wireFixed32 = 3
+	wireFixed64 = 4
+	wireBytes   = 5
+	wireGroup   = 6
+)
+
+var basicKinds = map[string]kind{
+	"int":     kindInt,
+	"int16":   kindInt,
+	"int32":   kindInt,
+	"int64":   kindInt,
+	"uint":    kindUint,
+	"uint16":  kindUint,
+	"uint32":  kindUint,
+	"uint64":  kindUint,
+	"int8":    kindInt8,
+	"uint8":   kindUint8,
+	"byte":    kindUint8,
+	"float32": kindFloat32,
+	"float64": kindFloat64,
+	"string":  kindString,
+}
+
+// goType is the type of a field or element.
+type goType struct {
+	kind kind
+	// expr is the type as it is written in the source.
+	expr string
+	elem *goType
+}
+
+func (t *goType) wireType() int {
+	switch t.kind {
+	case kindInt8, kindUint8:
+		return wireFixed8
+	case kindFloat32:
+		return wireFixed32
+	case kindFloat64:
+		return wireFixed64
+	case kindString, kindBytes, kindSlice:
+		return wireBytes
+	case kindPtr:
+		return t.elem.wireType()
+	case kindStruct:
+		return wireGroup
+	}
+	return wireVarint
+}
+
+// field is a field that is encoded. Fields of embedded structs tagged
+// ",flatten" are flattened into the struct that embeds them, as thresher does.
+type field struct {
+	// path selects the field from the receiver, such as "Meta.Name", and
+	// name is the last part of it.
+	path string
+	name string
+	id   uint64
+	t    *goType
+	// always is set by the "always" option; the field is written even if it
+	// is zero. Pointers are still only written if they are not nil. Fields
+	// with the required option are always written.
+	always   bool
+	required bool
+	// dflt is the default of the field as a Go literal. A field equal to its
+	// default is not written.
+	dflt string
+}
+
+func (f field) header() uint64 {
+	return f.id<<3 | uint64(f.t.wireType())
+}
+
+// structType is a struct that methods are generated for.
+type structType struct {
+	name   string
+	fields []field
+}
+
+// file is the result of parsing a Go source file.
+type file struct {
+	pkg     string
+	structs []*structType
+}
+
+type parseState struct {
+	fset  *token.FileSet
+	decls map[string]ast.Expr
+	// generated holds the names of the structs methods are generated for.
+	generated map[string]bool
+	// encodesSelf holds the types with a Marshal method declared in the file,
+	// which thresher encodes with those methods rather than by reflection.
+	encodesSelf map[string]bool
+}
+
+// parseFile finds the structs to generate methods for in a Go source file. If
+// names is empty, every struct with a RyeField tag is used.
+func parseFile(filename string, src interface{}, names []string) (*file, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	ps := &parseState{
+		fset:        fset,
+		decls:       make(map[string]ast.Expr),
+		generated:   make(map[string]bool),
+		encodesSelf: make(map[string]bool),
+	}
+	var order []string
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv != nil && fd.Name.Name == "Marshal" {
+			ps.encodesSelf[embeddedName(fd.Recv.List[0].Type)] = true
+		}
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, s := range gd.Specs {
+			ts := s.(*ast.TypeSpec)
+			if ts.TypeParams != nil {
+				continue
+			}
+			ps.decls[ts.Name.Name] = ts.Type
+			order = append(order, ts.Name.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		for _, name := range order {
+			if st, ok := ps.decls[name].(*ast.StructType); ok && ps.hasTaggedFields(st) {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := ps.decls[name].(*ast.StructType); !ok {
+			return nil, fmt.Errorf("ryegen: %s is not a struct declared in %s", name, filename)
+		}
+		ps.generated[name] = true
+	}
+
+	out := &file{
+		pkg: f.Name.Name,
+	}
+	for _, name := range names {
+		st := &structType{
+			name: name,
+		}
+		if err := ps.fields(st, ps.decls[name].(*ast.StructType), ""); err != nil {
+			return nil, err
+		}
+		seen := make(map[uint64]string, len(st.fields))
+		var required int
+		for _, f := range st.fields {
+			if f.required {
+				required++
+			}
+			if prev, dup := seen[f.id]; dup {
+				return nil, fmt.Errorf("ryegen: RyeField %d of %s is used by both %s and %s", f.id, name, prev, f.path)
+			}
+			seen[f.id] = f.path
+		}
+		if required > 64 {
+			return nil, fmt.Errorf("ryegen: %s has more than 64 required fields", name)
+		}
+		out.structs = append(out.structs, st)
+	}
+	return out, nil
+}
+
+func (ps *parseState) hasTaggedFields(st *ast.StructType) bool {
+	for _, f := range st.Fields.List {
+		if _, tagged := fieldTag(f, "RyeField"); tagged {
+			return true
+		}
+	}
+	return false
+}
+
+// localStruct returns the struct declared in the file that expr refers to,
+// directly or through a pointer.
+func (ps *parseState) localStruct(expr ast.Expr) (st *ast.StructType, ptr bool) {
+	if se, ok := expr.(*ast.StarExpr); ok {
+		expr, ptr = se.X, true
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		st, _ = ps.decls[id.Name].(*ast.StructType)
+	}
+	return st, ptr
+}
+
+// fields adds the fields of a struct to st in declaration order. prefix is the
+// path to an embedded struct.
+func (ps *parseState) fields(st *structType, s *ast.StructType, prefix string) error {
+	for _, f := range s.Fields.List {
+		tag, tagged := fieldTag(f, "RyeField")
+		if se, ok := f.Type.(*ast.SelectorExpr); ok && se.Sel.Name == "UnknownFields" {
+			return ps.errorf(f, "UnknownFields cannot be kept by generated methods")
+		}
+		if !tagged {
+			continue
+		}
+		ft, err := parseTag(tag)
+		if err != nil {
+			return ps.errorf(f, "%s", err)
+		}
+		if ft.skip {
+			continue
+		}
+		if ft.flatten {
+			if len(f.Names) > 0 {
+				return ps.errorf(f, "bad RyeField tag %q", tag)
+			}
+			est, ptr := ps.localStruct(f.Type)
+			if ptr {
+				return ps.errorf(f, "cannot flatten embedded pointer %s", types.ExprString(f.Type))
+			}
+			if est == nil {
+				return ps.errorf(f, "cannot flatten %s, it is not a struct in this file", types.ExprString(f.Type))
+			}
+			if err := ps.fields(st, est, prefix+embeddedName(f.Type)+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if dflt, found := fieldTag(f, "RyeDefault"); found {
+			if ft.hasDefault {
+				return ps.errorf(f, "default is set by both RyeField and RyeDefault")
+			}
+			ft.dflt, ft.hasDefault = dflt, true
+		}
+		t, err := ps.resolve(f.Type, true)
+		if err != nil {
+			return ps.errorf(f, "%s", err)
+		}
+		var dflt string
+		if ft.hasDefault {
+			if dflt, err = defaultLiteral(t, ft.dflt); err != nil {
+				return ps.errorf(f, "%s", err)
+			}
+		}
+		names := []string{embeddedName(f.Type)}
+		if len(f.Names) > 0 {
+			names = names[:0]
+			for _, n := range f.Names {
+				names = append(names, n.Name)
+			}
+		}
+		for _, n := range names {
+			st.fields = append(st.fields, field{
+				path:     prefix + n,
+				name:     n,
+				id:       ft.id,
+				t:        t,
+				always:   (ft.always || ft.required) && t.kind != kindPtr,
+				required: ft.required,
+				dflt:     dflt,
+			})
+		}
+	}
+	return nil
+}
+
+// resolve finds how a type is encoded. field is true for the type of a struct
+// field, which affects how pointers are written.
+func (ps *parseState) resolve(expr ast.Expr, field bool) (*goType, error) {
+	str := types.ExprString(expr)
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if k, ok := basicKinds[e.Name]; ok {
+			return &goType{kind: k, expr: str}, nil
+		}
+		decl, ok := ps.decls[e.Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %s", str)
+		}
+		if ps.encodesSelf[e.Name] && !ps.generated[e.Name] {
+			return nil, fmt.Errorf("unsupported type %s, it has a Marshal method", str)
+		}
+		if _, ok := decl.(*ast.StructType); ok {
+			if !ps.generated[e.Name] {
+				return nil, fmt.Errorf("struct %s does not have generated methods", str)
+			}
+			return &goType{kind: kindStruct, expr: str}, nil
+		}
+		t, err := ps.resolve(decl, field)
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == kindStruct {
+			// a defined type does not have the methods of the struct
+			return nil, fmt.Errorf("unsupported type %s", str)
+		}
+		named := *t
+		named.expr = str
+		return &named, nil
+	case *ast.StarExpr:
+		elem, err := ps.resolve(e.X, false)
+		if err != nil {
+			return nil, err
+		}
+		if field && elem.kind == kindPtr {
+			return nil, fmt.Errorf("unsupported pointer to pointer %s", str)
+		}
+		return &goType{kind: kindPtr, expr: str, elem: elem}, nil
+	case *ast.ArrayType:
+		if e.Len != nil {
+			return nil, fmt.Errorf("unsupported array %s", str)
+		}
+		if elem := types.ExprString(e.Elt); elem == "byte" || elem == "uint8" {
+			return &goType{kind: kindBytes, expr: str}, nil
+		}
+		elem, err := ps.resolve(e.Elt, false)
+		if err != nil {
+			return nil, err
+		}
+		if elem.kind == kindUint8 {
+			return nil, fmt.Errorf("unsupported slice %s, use []byte", str)
+		}
+		return &goType{kind: kindSlice, expr: str, elem: elem}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", str)
+}
+
+func (ps *parseState) errorf(f *ast.Field, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: ryegen: %s", ps.fset.Position(f.Pos()), fmt.Sprintf(format, args...))
+}
+
+func fieldTag(f *ast.Field, key string) (string, bool) {
+	if f.Tag == nil {
+		return "", false
+	}
+	tag, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		return "", false
+	}
+	return reflect.StructTag(tag).Lookup(key)
+}
+
+// ryeTag is a parsed RyeField tag.
+type ryeTag struct {
+	id         uint64
+	skip       bool
+	flatten    bool
+	always     bool
+	required   bool
+	dflt       string
+	hasDefault bool
+}
+
+// parseTag parses a RyeField tag the same way thresher does. The "omitzero"
+// option is accepted but has no effect because generated methods are not used
+// when a Thresher sets WriteZero.
+func parseTag(tag string) (ryeTag, error) {
+	parts := strings.Split(tag, ",")
+	if parts[0] == "-" {
+		return ryeTag{skip: true}, nil
+	}
+	if parts[0] == "" && len(parts) == 2 && strings.TrimSpace(parts[1]) == "flatten" {
+		return ryeTag{flatten: true}, nil
+	}
+	bad := fmt.Errorf("bad RyeField tag %q", tag)
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || id == 0 || id > 1<<61-1 {
+		return ryeTag{}, bad
+	}
+	ft := ryeTag{id: id}
+	var omitZero bool
+	for _, opt := range parts[1:] {
+		switch opt = strings.TrimSpace(opt); {
+		case opt == "always":
+			ft.always = true
+		case opt == "omitzero":
+			omitZero = true
+		case opt == "required":
+			ft.required = true
+		case strings.HasPrefix(opt, "default=") && !ft.hasDefault:
+			ft.dflt, ft.hasDefault = strings.TrimPrefix(opt, "default="), true
+		default:
+			return ryeTag{}, bad
+		}
+	}
+	if omitZero && (ft.always || ft.required) {
+		return ryeTag{}, bad
+	}
+	return ft, nil
+}
+
+// defaultLiteral checks that s is a default thresher accepts for a field of
+// type t and returns it as a Go literal. A default that does not fit the exact
+// type is reported by the compiler.
+func defaultLiteral(t *goType, s string) (string, error) {
+	bad := fmt.Errorf("bad default %q for %s", s, t.expr)
+	switch t.kind {
+	case kindInt, kindInt8:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", bad
+		}
+		return strconv.FormatInt(i, 10), nil
+	case kindUint, kindUint8:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return "", bad
+		}
+		return strconv.FormatUint(u, 10), nil
+	case kindFloat32, kindFloat64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return "", bad
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case kindString:
+		return strconv.Quote(s), nil
+	}
+	return "", fmt.Errorf("unsupported default for %s", t.expr)
+}
+
+// embeddedName is the name of an embedded field of type expr.
+func embeddedName(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.StarExpr:
+		return embeddedName(e.X)
+	case *ast.SelectorExpr:
+		return e.Sel.Name
+	case *ast.Ident:
+		return e.Name
+	}
+	return ""
+}
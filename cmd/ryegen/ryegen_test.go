@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExample checks that the generated files in example are up to date. The
+// tests in example check the generated code against thresher.
+func TestExample(t *testing.T) {
+	f, err := parseFile("example/shapes.go", nil, nil)
+	assert.NoError(t, err)
+
+	got, err := generate(f, "shapes.go")
+	assert.NoError(t, err)
+	want, err := os.ReadFile("example/shapes_rye.go")
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+
+	got, err = generateTest(f, "shapes.go")
+	assert.NoError(t, err)
+	want, err = os.ReadFile("example/shapes_rye_test.go")
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestTypeNames(t *testing.T) {
+	f, err := parseFile("example/shapes.go", nil, []string{"Point"})
+	assert.NoError(t, err)
+	assert.Len(t, f.structs, 1)
+	assert.Equal(t, "Point", f.structs[0].name)
+
+	_, err = parseFile("example/shapes.go", nil, []string{"Color"})
+	assert.EqualError(t, err, "ryegen: Color is not a struct declared in example/shapes.go")
+
+	// Shape uses Point which must also be generated
+	_, err = parseFile("example/shapes.go", nil, []string{"Shape", "Meta"})
+	assert.EqualError(t, err, "example/shapes.go:25:2: ryegen: struct Point does not have generated methods")
+}
+
+func TestUnsupported(t *testing.T) {
+	tt := map[string]string{
+		"map[string]int": "unsupported type map[string]int",
+		"[4]byte":        "unsupported array [4]byte",
+		"time.Time":      "unsupported type time.Time",
+		"interface{}":    "unsupported type interface{}",
+		"bool":           "unsupported type bool",
+		"**int":          "unsupported pointer to pointer **int",
+		"Custom":         "unsupported type Custom, it has a Marshal method",
+	}
+	for typ, expected := range tt {
+		t.Run(typ, func(t *testing.T) {
+			src := "package p\n\ntype Custom struct{}\n\nfunc (*Custom) Marshal() {}\n\ntype T struct {\n\tF " + typ + " `RyeField:\"1\"`\n}\n"
+			_, err := parseFile("p.go", src, []string{"T"})
+			assert.EqualError(t, err, "p.go:8:2: ryegen: "+expected)
+		})
+	}
+
+	_, err := parseFile("p.go", "package p\n\ntype T struct {\n\tA int `RyeField:\"1\"`\n\tB int `RyeField:\"1\"`\n}\n", nil)
+	assert.EqualError(t, err, "ryegen: RyeField 1 of T is used by both A and B")
+
+	_, err = parseFile("p.go", "package p\n\ntype E struct {\n\tA int `RyeField:\"1\"`\n}\n\ntype T struct {\n\t*E `RyeField:\",flatten\"`\n}\n", []string{"T"})
+	assert.EqualError(t, err, "p.go:8:2: ryegen: cannot flatten embedded pointer *E")
+
+	_, err = parseFile("p.go", "package p\n\nimport \"example.com/meta\"\n\ntype T struct {\n\tmeta.Meta `RyeField:\",flatten\"`\n}\n", []string{"T"})
+	assert.EqualError(t, err, "p.go:6:2: ryegen: cannot flatten meta.Meta, it is not a struct in this file")
+
+	_, err = parseFile("p.go", "package p\n\ntype E int\n\ntype T struct {\n\tE `RyeField:\",flatten\"`\n}\n", []string{"T"})
+	assert.EqualError(t, err, "p.go:6:2: ryegen: cannot flatten E, it is not a struct in this file")
+
+	_, err = parseFile("p.go", "package p\n\ntype T struct {\n\tA int `RyeField:\"1,sometimes\"`\n}\n", nil)
+	assert.EqualError(t, err, `p.go:4:2: ryegen: bad RyeField tag "1,sometimes"`)
+
+	_, err = parseFile("p.go", "package p\n\ntype T struct {\n\tA int `RyeField:\"1,default=x\"`\n}\n", nil)
+	assert.EqualError(t, err, `p.go:4:2: ryegen: bad default "x" for int`)
+
+	_, err = parseFile("p.go", "package p\n\ntype T struct {\n\tA []int `RyeField:\"1\" RyeDefault:\"1\"`\n}\n", nil)
+	assert.EqualError(t, err, `p.go:4:2: ryegen: unsupported default for []int`)
+
+	_, err = parseFile("p.go", "package p\n\ntype E struct {\n\tA int `RyeField:\"1\"`\n}\n\ntype T struct {\n\tF E `RyeField:\",flatten\"`\n}\n", []string{"T"})
+	assert.EqualError(t, err, `p.go:8:2: ryegen: bad RyeField tag ",flatten"`)
+}
+
+func TestEmbedded(t *testing.T) {
+	src := "package p\n\ntype E struct {\n\tA int `RyeField:\"1\"`\n}\n\ntype T struct {\n\tE `RyeField:\",flatten\"`\n\tB int `RyeField:\"2\"`\n}\n\ntype U struct {\n\tE\n\tB int `RyeField:\"2\"`\n}\n"
+	f, err := parseFile("p.go", src, []string{"T", "U"})
+	assert.NoError(t, err)
+	var paths [][]string
+	for _, st := range f.structs {
+		var p []string
+		for _, fd := range st.fields {
+			p = append(p, fd.path)
+		}
+		paths = append(paths, p)
+	}
+	// without the flatten option an untagged embedded struct is ignored
+	assert.Equal(t, [][]string{{"E.A", "B"}, {"B"}}, paths)
+}
@@ -0,0 +1,234 @@
+package thresher
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"time"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+// builtinCodecs are used for types from the standard library that cannot be
+// encoded by reflection. time.Duration is an int64 and is encoded as one
+// without a Codec.
+var builtinCodecs = map[reflect.Type]Codec{
+	reflect.TypeOf(time.Time{}):       timeCodec{},
+	reflect.TypeOf((*big.Int)(nil)):   bigIntCodec{},
+	reflect.TypeOf((*big.Float)(nil)): bigFloatCodec{},
+	reflect.TypeOf(net.IP(nil)):       ipCodec{},
+	reflect.TypeOf(netip.Addr{}):      addrCodec{},
+}
+
+var (
+	minUnixNano = time.Unix(0, -1<<63)
+	maxUnixNano = time.Unix(0, 1<<63-1)
+)
+
+// timeCodec writes a time.Time as the Compact Int64 Unix nanoseconds followed
+// by the zone offset in seconds. The zero time is written with no bytes. The
+// zone name and monotonic clock are not kept; a decoded time is in UTC if the
+// offset is 0 and in a fixed zone otherwise.
+type timeCodec struct{}
+
+func (timeCodec) Size(p unsafe.Pointer) int {
+	tm := (*time.Time)(p)
+	if tm.IsZero() {
+		return 0
+	}
+	_, offset := tm.Zone()
+	return rye.CompactInt64Size(tm.UnixNano()) + rye.CompactInt64Size(int64(offset))
+}
+
+func (timeCodec) Zero(p unsafe.Pointer) bool {
+	return (*time.Time)(p).IsZero()
+}
+
+func (timeCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	tm := (*time.Time)(p)
+	if tm.IsZero() {
+		return nil
+	}
+	if tm.Before(minUnixNano) || tm.After(maxUnixNano) {
+		return errors.New("thresher: time.Time cannot be represented in Unix nanoseconds")
+	}
+	_, offset := tm.Zone()
+	s.CompactInt64(tm.UnixNano())
+	s.CompactInt64(int64(offset))
+	return nil
+}
+
+func (timeCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	tm := (*time.Time)(p)
+	if len(d.Data) == 0 {
+		*tm = time.Time{}
+		return nil
+	}
+	nano := d.CompactInt64()
+	loc := time.UTC
+	if offset := int(d.CompactInt64()); offset != 0 {
+		loc = time.FixedZone("", offset)
+	}
+	*tm = time.Unix(0, nano).In(loc)
+	return nil
+}
+
+// bigIntCodec writes a *big.Int as a sign byte, 1 if it is negative, followed
+// by the big-endian bytes of its absolute value. A nil pointer is zero as a
+// field and is written with no bytes so that it stays nil in a slice.
+type bigIntCodec struct{}
+
+func (bigIntCodec) Size(p unsafe.Pointer) int {
+	i := *(**big.Int)(p)
+	if i == nil {
+		return 0
+	}
+	return 1 + (i.BitLen()+7)/8
+}
+
+func (bigIntCodec) Zero(p unsafe.Pointer) bool {
+	return *(**big.Int)(p) == nil
+}
+
+func (bigIntCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	i := *(**big.Int)(p)
+	if i == nil {
+		return nil
+	}
+	if i.Sign() < 0 {
+		s.Byte(1)
+	} else {
+		s.Byte(0)
+	}
+	ln := (i.BitLen() + 7) / 8
+	i.FillBytes(s.Data[s.Idx : s.Idx+ln])
+	s.Idx += ln
+	return nil
+}
+
+func (bigIntCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	if len(d.Data) == 0 {
+		*(**big.Int)(p) = nil
+		return nil
+	}
+	i := new(big.Int)
+	neg := d.Byte() == 1
+	i.SetBytes(d.Data[d.Idx:])
+	if neg {
+		i.Neg(i)
+	}
+	*(**big.Int)(p) = i
+	return nil
+}
+
+// bigFloatCodec writes a *big.Float with GobEncode so that the precision and
+// rounding mode are kept. A nil pointer is zero as a field and is written with
+// no bytes, which GobEncode never returns for a non-nil *big.Float. The size
+// of the encoding depends on the mantissa, which is not exported, so it is a
+// blobCodec and GobEncode is only called once.
+type bigFloatCodec struct{}
+
+func (bigFloatCodec) encode(p unsafe.Pointer) ([]byte, error) {
+	return (*(**big.Float)(p)).GobEncode()
+}
+
+func (c bigFloatCodec) Size(p unsafe.Pointer) int {
+	b, _ := c.encode(p)
+	return len(b)
+}
+
+func (bigFloatCodec) Zero(p unsafe.Pointer) bool {
+	return *(**big.Float)(p) == nil
+}
+
+func (c bigFloatCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	b, err := c.encode(p)
+	if err != nil {
+		return err
+	}
+	s.Slice(b)
+	return nil
+}
+
+func (bigFloatCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	if len(d.Data) == 0 {
+		*(**big.Float)(p) = nil
+		return nil
+	}
+	f := new(big.Float)
+	if err := f.GobDecode(d.Data); err != nil {
+		return err
+	}
+	*(**big.Float)(p) = f
+	return nil
+}
+
+// ipCodec writes an IPv4 net.IP as 4 bytes and any other as its 16 bytes. This
+// is the same wire format as a []byte so data written before the codec existed
+// can still be read.
+type ipCodec struct{}
+
+func (ipCodec) ip(p unsafe.Pointer) net.IP {
+	ip := *(*net.IP)(p)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (c ipCodec) Size(p unsafe.Pointer) int {
+	return len(c.ip(p))
+}
+
+func (ipCodec) Zero(p unsafe.Pointer) bool {
+	return len(*(*net.IP)(p)) == 0
+}
+
+func (c ipCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	s.Slice(c.ip(p))
+	return nil
+}
+
+func (ipCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	*(*net.IP)(p) = append(net.IP(nil), d.Data...)
+	return nil
+}
+
+// addrCodec writes a netip.Addr in the format of its MarshalBinary method.
+type addrCodec struct{}
+
+func (addrCodec) Size(p unsafe.Pointer) int {
+	a := (*netip.Addr)(p)
+	switch {
+	case a.Is4():
+		return 4
+	case a.IsValid():
+		return 16 + len(a.Zone())
+	}
+	return 0
+}
+
+func (addrCodec) Zero(p unsafe.Pointer) bool {
+	return !(*netip.Addr)(p).IsValid()
+}
+
+func (addrCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	a := (*netip.Addr)(p)
+	switch {
+	case a.Is4():
+		b := a.As4()
+		s.Slice(b[:])
+	case a.IsValid():
+		b := a.As16()
+		s.Slice(b[:])
+		s.String(a.Zone())
+	}
+	return nil
+}
+
+func (addrCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	return (*netip.Addr)(p).UnmarshalBinary(d.Data)
+}
@@ -0,0 +1,104 @@
+package thresher
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+// Codec encodes a type that the Thresher cannot encode by reflection, usually a
+// type from another package. Each method is passed a pointer to a value of the
+// type the Codec was registered for. Size must return the exact number of bytes
+// Marshal will write. The value is prefixed with its size so Unmarshal is given
+// a Deserializer holding only the bytes written by Marshal; they are only valid
+// during the call and must be copied if they are retained.
+type Codec interface {
+	Size(p unsafe.Pointer) int
+	Zero(p unsafe.Pointer) bool
+	Marshal(p unsafe.Pointer, s *rye.Serializer) error
+	Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error
+}
+
+// RegisterCodec sets the Codec used for rt in place of reflection. Codecs are
+// built in for time.Time, *big.Int, *big.Float, net.IP and netip.Addr; a Codec
+// registered for one of those types replaces it and a nil Codec restores
+// encoding by reflection. Codecs are used when a type is compiled so
+// RegisterCodec must be called before any type that uses rt is registered.
+func (t *Thresher) RegisterCodec(rt reflect.Type, codec Codec) error {
+	return t.update(func(c *compiler) {
+		if rt == nil {
+			panic(errors.New("thresher: cannot register a Codec for a nil type"))
+		}
+		c.codecs[rt] = codec
+	})
+}
+
+// codec returns the Codec for rt or nil if it does not have one.
+func (r *registry) codec(rt reflect.Type) Codec {
+	if c, found := r.codecs[rt]; found {
+		return c
+	}
+	return builtinCodecs[rt]
+}
+
+// blobCodec is implemented by a built in Codec that can only produce its
+// encoding as a byte slice. It is encoded once during the first pass and
+// Size and Marshal are not called.
+type blobCodec interface {
+	encode(p unsafe.Pointer) ([]byte, error)
+}
+
+// codecOp delegates to a Codec.
+type codecOp struct {
+	rt    reflect.Type
+	codec Codec
+}
+
+func (c codecOp) size(u unsafe.Pointer, s *encoder) int {
+	if bc, ok := c.codec.(blobCodec); ok {
+		b, err := bc.encode(u)
+		if err != nil {
+			panic(err)
+		}
+		return s.addBlob(b)
+	}
+	idx := s.startSize()
+	return s.endSize(idx, c.codec.Size(u))
+}
+
+func (c codecOp) zero(u unsafe.Pointer) bool {
+	return c.codec.Zero(u)
+}
+
+func (c codecOp) marshal(u unsafe.Pointer, s *encoder) {
+	if _, ok := c.codec.(blobCodec); ok {
+		b := s.nextBlob()
+		s.CompactUint64(uint64(len(b)))
+		s.Slice(b)
+		return
+	}
+	size := s.nextSize()
+	s.CompactUint64(size)
+	start := s.Idx
+	if err := c.codec.Marshal(u, s.Serializer); err != nil {
+		panic(err)
+	}
+	if wrote := uint64(s.Idx - start); wrote != size {
+		panic(fmt.Errorf("thresher: codec for %s wrote %d bytes but Size returned %d", c.rt, wrote, size))
+	}
+}
+
+func (c codecOp) unmarshal(u unsafe.Pointer, d *decoder) {
+	ln := d.CompactUint64()
+	d.stringLen(ln)
+	if err := c.codec.Unmarshal(u, d.Sub(int(ln))); err != nil {
+		panic(err)
+	}
+}
+
+func (codecOp) wireType() wireType {
+	return wireBytes
+}
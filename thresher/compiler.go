@@ -1,21 +1,84 @@
 package thresher
 
 import (
-	"errors"
+	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
-func (t *Thresher) compile(rt reflect.Type) uintPtrOp {
+// fieldPath tracks where in the type graph compile is so that errors can name
+// the offending field.
+type fieldPath struct {
+	strct string
+	path  string
+}
+
+func (p fieldPath) field(strct reflect.Type, name string) fieldPath {
+	return fieldPath{
+		strct: strct.String(),
+		path:  p.path + "." + name,
+	}
+}
+
+func (p fieldPath) elem() fieldPath {
+	p.path += "[]"
+	return p
+}
+
+func (p fieldPath) unsupported(k reflect.Kind) ErrUnsupported {
+	return ErrUnsupported{
+		Struct: p.strct,
+		Path:   p.path,
+		Kind:   k,
+	}
+}
+
+func rootPath(rt reflect.Type) fieldPath {
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	return fieldPath{path: rt.String()}
+}
+
+func (t *compiler) compile(rt reflect.Type, p fieldPath) uintPtrOp {
+	if c := t.codec(rt); c != nil {
+		return codecOp{
+			rt:    rt,
+			codec: c,
+		}
+	}
+	if elem, ok := lazyElem(rt); ok {
+		return t.compileLazy(rt, elem, p)
+	}
+	if t.generated(rt) {
+		// compiled for the Schema and to decode it; the generated methods are
+		// used to encode it unless checkGenerated finds they cannot be
+		_, found := t.structMarshallers[rt]
+		sm := t.compileStruct(rt, p)
+		if !found {
+			t.pendingGenerated = append(t.pendingGenerated, sm)
+		}
+		return generatedOp{
+			rt: rt,
+			sm: sm,
+		}
+	}
+	if kind := t.custom(rt); kind != customNone {
+		return customOp{
+			rt:   rt,
+			kind: kind,
+		}
+	}
 	switch rt.Kind() {
 	case reflect.Ptr:
 		rt = rt.Elem()
 		return ptrMarshaller{
-			op: t.compile(rt),
+			op: t.compile(rt, p),
 			t:  rt,
 		}
 	case reflect.Struct:
-		return t.compileStruct(rt)
+		return t.compileStruct(rt, p)
 	case reflect.String:
 		return uintPtrOpString{}
 	case reflect.Int:
@@ -43,71 +106,306 @@ func (t *Thresher) compile(rt reflect.Type) uintPtrOp {
 	case reflect.Float64:
 		return uintPtrOpFloat64{}
 	case reflect.Slice:
-		return t.compileSlice(rt.Elem())
+		if rt.Elem().Kind() == reflect.Uint8 {
+			return uintPtrOpByteSlice{
+				nilSlices: t.NilSlices,
+				nested:    t.NilSlices,
+			}
+		}
+		return t.compileSlice(rt.Elem(), p.elem())
 	case reflect.Interface:
 		return interfaceMarshaller{
-			t:  t,
 			rt: rt,
 		}
 	}
-	return nil
+	panic(p.unsupported(rt.Kind()))
+}
+
+// compileField compiles the op for a struct field. Fields that are zero are not
+// written, so a pointer field does not need a presence byte. A pointer to a
+// pointer is wrapped so the field remains self-delimiting, as are all pointers
+// when tracking references.
+func (t *compiler) compileField(rt reflect.Type, p fieldPath) uintPtrOp {
+	if rt.Kind() != reflect.Ptr || t.codec(rt) != nil {
+		return fieldOp(t.compile(rt, p))
+	}
+	if t.TrackRefs {
+		// a back reference is not the same wire type as the value
+		return delimited{t.compile(rt, p)}
+	}
+	elem := rt.Elem()
+	op := t.compile(elem, p)
+	if elem.Kind() == reflect.Ptr {
+		op = delimited{op}
+	}
+	return ptrFieldMarshaller{
+		op: op,
+		t:  elem,
+	}
+}
+
+// fieldOp returns op as the value of a struct field. A []byte field, including
+// one held by a Lazy, is not nested because a nil field is not written.
+func fieldOp(op uintPtrOp) uintPtrOp {
+	switch o := op.(type) {
+	case uintPtrOpByteSlice:
+		o.nested = false
+		return o
+	case lazyOp:
+		o.op = fieldOp(o.op)
+		return o
+	}
+	return op
+}
+
+// fieldTag is the parsed form of a RyeField tag. A tag of "-" explicitly
+// ignores the field. The ID can be followed by options: "always" writes the
+// field even if it is zero and "omitzero" does not, overriding WriteZero.
+// "default=v" sets the value of the field when it is not in the data; since
+// options are split on commas a default that has one is given with a
+// RyeDefault tag instead. "required" makes Unmarshal return ErrRequired if the
+// field is not in the data; it is written even if it is zero. An embedded
+// struct tagged ",flatten" has no ID of its own; its fields are flattened into
+// the struct embedding it.
+type fieldTag struct {
+	id         uint64
+	skip       bool
+	flatten    bool
+	always     bool
+	omitZero   bool
+	required   bool
+	dflt       string
+	hasDefault bool
+}
+
+func parseTag(rt reflect.Type, f reflect.StructField) fieldTag {
+	tag, found := f.Tag.Lookup("RyeField")
+	if !found {
+		return fieldTag{skip: true}
+	}
+	parts := strings.Split(tag, ",")
+	if parts[0] == "-" {
+		return fieldTag{skip: true}
+	}
+	bad := ErrBadTag{
+		Struct: rt.String(),
+		Field:  f.Name,
+		Tag:    tag,
+	}
+	if parts[0] == "" && len(parts) == 2 && strings.TrimSpace(parts[1]) == "flatten" {
+		if !f.Anonymous {
+			panic(bad)
+		}
+		return fieldTag{flatten: true}
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || id == 0 || id > maxFieldID {
+		panic(bad)
+	}
+	ft := fieldTag{id: id}
+	for _, opt := range parts[1:] {
+		switch opt = strings.TrimSpace(opt); {
+		case opt == "always":
+			ft.always = true
+		case opt == "omitzero":
+			ft.omitZero = true
+		case opt == "required":
+			ft.required = true
+		case strings.HasPrefix(opt, "default=") && !ft.hasDefault:
+			ft.dflt, ft.hasDefault = strings.TrimPrefix(opt, "default="), true
+		default:
+			panic(bad)
+		}
+	}
+	if dflt, found := f.Tag.Lookup("RyeDefault"); found {
+		if ft.hasDefault {
+			panic(bad)
+		}
+		ft.dflt, ft.hasDefault = dflt, true
+	}
+	if ft.omitZero && (ft.always || ft.required) {
+		panic(bad)
+	}
+	return ft
+}
+
+// writeZero reports whether a field is written when it is zero. A nil pointer
+// or interface field is never written; it is how they record that they were
+// not set, so a pointer to a zero value is written regardless.
+func (t *compiler) writeZero(tag fieldTag, rt reflect.Type) bool {
+	if k := rt.Kind(); k == reflect.Ptr || k == reflect.Interface {
+		return false
+	}
+	return tag.always || tag.required || (t.WriteZero && !tag.omitZero)
 }
 
-func (t *Thresher) compileStruct(rt reflect.Type) *structMarshaller {
-	if t.structMarshallers == nil {
-		t.structMarshallers = make(map[reflect.Type]*structMarshaller)
+// parseReserved parses a RyeReserved tag. IDs are comma separated and a range
+// of IDs can be given as "8-10".
+func parseReserved(rt reflect.Type, f reflect.StructField, tag string) []uint64 {
+	bad := ErrBadTag{
+		Struct: rt.String(),
+		Field:  f.Name,
+		Tag:    tag,
+	}
+	var out []uint64
+	for _, part := range strings.Split(tag, ",") {
+		rng := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		start, err := strconv.ParseUint(rng[0], 10, 64)
+		if err != nil || start == 0 || start > maxFieldID {
+			panic(bad)
+		}
+		end := start
+		if len(rng) == 2 {
+			end, err = strconv.ParseUint(rng[1], 10, 64)
+			if err != nil || end < start || end > maxFieldID {
+				panic(bad)
+			}
+		}
+		for id := start; id <= end; id++ {
+			out = append(out, id)
+		}
 	}
+	return out
+}
+
+func (t *compiler) compileStruct(rt reflect.Type, p fieldPath) *structMarshaller {
 	if sm, found := t.structMarshallers[rt]; found {
 		return sm
 	}
 	ln := rt.NumField()
 	sm := &structMarshaller{
 		byOrder: make([]structField, 0, ln),
+		rt:      rt,
 	}
 	t.structMarshallers[rt] = sm
+	t.compileFields(sm, rt, 0, p)
+	sm.validate = reflect.PtrTo(rt).Implements(validatorType)
+	if sm.required > 0 || sm.validate {
+		t.checks = true
+	}
 	var max uint64
-	for i := 0; i < ln; i++ {
+	for _, f := range sm.byOrder {
+		if id, _ := splitHeader(f.fieldHeader); id > max {
+			max = id
+		}
+	}
+	sm.byId = make([]structField, max+1)
+	for _, f := range sm.byOrder {
+		if f.fieldHeader == 0 {
+			continue
+		}
+		id, _ := splitHeader(f.fieldHeader)
+		if sm.byId[id].fieldHeader != 0 {
+			panic(ErrFieldRedefined{
+				Struct:   rt.String(),
+				ID:       id,
+				Field:    f.name,
+				Previous: sm.byId[id].name,
+			})
+		}
+		sm.byId[id] = f
+	}
+	for _, id := range sm.reserved {
+		if id < uint64(len(sm.byId)) && sm.byId[id].fieldHeader != 0 {
+			panic(ErrReserved{
+				Struct: rt.String(),
+				Field:  sm.byId[id].name,
+				ID:     id,
+			})
+		}
+	}
+	return sm
+}
+
+// compileFields appends the fields of rt to sm with their offsets shifted by
+// base. An embedded struct tagged ",flatten" is flattened so that its tagged
+// fields share the ID space of the struct embedding it. An embedded struct
+// with an ID is encoded as a nested struct like any other field, and one
+// without a tag is ignored.
+func (t *compiler) compileFields(sm *structMarshaller, rt reflect.Type, base uintptr, p fieldPath) {
+	for i := 0; i < rt.NumField(); i++ {
 		f := rt.Field(i)
-		var skip bool
-		idStr, found := f.Tag.Lookup("RyeField")
-		if !found {
-			skip = true
+		offset := base + f.Offset
+		if tag, found := f.Tag.Lookup("RyeReserved"); found && f.Name == "_" {
+			sm.reserved = append(sm.reserved, parseReserved(rt, f, tag)...)
+			continue
 		}
-		id, err := strconv.ParseUint(idStr, 10, 64)
-		if err != nil || id == 0 {
-			skip = true
+		if f.Type == unknownFieldsType && !sm.hasUnknown {
+			sm.unknown = offset
+			sm.hasUnknown = true
+			sm.byOrder = append(sm.byOrder, structField{
+				offset:    offset,
+				uintPtrOp: uintPtrOpSkip{},
+			})
+			continue
 		}
-		if id > max {
-			max = id
+		tag := parseTag(rt, f)
+		if tag.flatten {
+			switch f.Type.Kind() {
+			case reflect.Struct:
+				t.compileFields(sm, f.Type, offset, p.field(rt, f.Name))
+				continue
+			case reflect.Ptr:
+				// flattening through a pointer would need to allocate on
+				// decode; embed by value or give the embedding an ID instead
+				panic(p.field(rt, f.Name).unsupported(reflect.Ptr))
+			}
+			panic(ErrBadTag{
+				Struct: rt.String(),
+				Field:  f.Name,
+				Tag:    f.Tag.Get("RyeField"),
+			})
 		}
 		sf := structField{
-			offset: f.Offset,
+			offset: offset,
+			name:   f.Name,
+			rt:     f.Type,
 		}
-		if skip {
+		if tag.skip {
 			sf.uintPtrOp = uintPtrOpSkip{}
 			sf.fieldHeader = 0
 		} else {
-			sf.uintPtrOp = t.compile(f.Type)
-			sf.fieldHeader = id
+			sf.uintPtrOp = t.compileField(f.Type, p.field(rt, f.Name))
+			sf.fieldHeader = makeHeader(tag.id, sf.wireType())
+			sf.always = t.writeZero(tag, f.Type)
+			if tag.hasDefault {
+				sf.dflt = compileDefault(sf.uintPtrOp, rt, f, tag)
+				sm.hasDefaults = true
+			}
+			if tag.required {
+				if sm.required == maxRequired {
+					panic(fmt.Errorf("thresher: %s has more than %d required fields", sm.rt, maxRequired))
+				}
+				sm.required++
+				sf.required = sm.required
+			}
 		}
 		sm.byOrder = append(sm.byOrder, sf)
 	}
-	sm.byId = make([]structField, max+1)
-	for _, f := range sm.byOrder {
-		if f.fieldHeader == 0 {
-			continue
-		}
-		if sm.byId[f.fieldHeader].fieldHeader != 0 {
-			panic(errors.New("RyeField redefined"))
-		}
-		sm.byId[f.fieldHeader] = f
+}
+
+// compileDefault parses the default of a field. A field encoded by a Codec or
+// by its own methods cannot have one.
+func compileDefault(op uintPtrOp, rt reflect.Type, f reflect.StructField, tag fieldTag) *fieldDefault {
+	bad := ErrBadTag{
+		Struct: rt.String(),
+		Field:  f.Name,
+		Tag:    string(f.Tag),
 	}
-	return sm
+	switch op.(type) {
+	case codecOp, customOp:
+		panic(bad)
+	}
+	return parseDefault(f.Type, tag.dflt, bad)
 }
 
-func (t *Thresher) compileSlice(rt reflect.Type) sliceMarshaller {
+var unknownFieldsType = reflect.TypeOf(UnknownFields(nil))
+
+func (t *compiler) compileSlice(rt reflect.Type, p fieldPath) sliceMarshaller {
 	return sliceMarshaller{
+		nilSlices: t.NilSlices,
 		recordLen: rt.Size(),
-		op:        t.compile(rt),
+		op:        t.compile(rt, p),
+		rt:        reflect.SliceOf(rt),
 	}
 }
@@ -0,0 +1,136 @@
+package thresher
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+var (
+	marshalerType         = reflect.TypeOf((*rye.Marshaler)(nil)).Elem()
+	unmarshalerType       = reflect.TypeOf((*rye.Unmarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// customKind is the interface a type uses to encode itself.
+type customKind byte
+
+const (
+	customNone customKind = iota
+	customRye
+	customBinary
+	customText
+)
+
+// custom returns how rt encodes itself. A type must implement both halves
+// of an interface pair, either on the type or on a pointer to it, otherwise it
+// is encoded by reflection. rye.Marshaler is always used; the encoding
+// interfaces are only used if EncodingMarshalers is set. A Generated type
+// implements rye.Marshaler but is never custom; it is a struct either way.
+func (t *Thresher) custom(rt reflect.Type) customKind {
+	if rt.Kind() == reflect.Ptr || rt.Kind() == reflect.Interface {
+		return customNone
+	}
+	pt := reflect.PtrTo(rt)
+	if pt.Implements(generatedType) {
+		return customNone
+	}
+	if pt.Implements(marshalerType) && pt.Implements(unmarshalerType) {
+		return customRye
+	}
+	if !t.EncodingMarshalers {
+		return customNone
+	}
+	if pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType) {
+		return customBinary
+	}
+	if pt.Implements(textMarshalerType) && pt.Implements(textUnmarshalerType) {
+		return customText
+	}
+	return customNone
+}
+
+// customOp delegates to a type that encodes itself. The value is prefixed with
+// its length so that it can be skipped without knowing the type.
+type customOp struct {
+	rt   reflect.Type
+	kind customKind
+}
+
+// value returns a pointer to the value at u as an interface.
+func (c customOp) value(u unsafe.Pointer) interface{} {
+	return reflect.NewAt(c.rt, u).Interface()
+}
+
+func (c customOp) size(u unsafe.Pointer, s *encoder) int {
+	var (
+		b   []byte
+		err error
+	)
+	switch c.kind {
+	case customRye:
+		idx := s.startSize()
+		return s.endSize(idx, c.value(u).(rye.Marshaler).MarshalSize())
+	case customBinary:
+		b, err = c.value(u).(encoding.BinaryMarshaler).MarshalBinary()
+	case customText:
+		b, err = c.value(u).(encoding.TextMarshaler).MarshalText()
+	}
+	if err != nil {
+		panic(err)
+	}
+	return s.addBlob(b)
+}
+
+func (c customOp) zero(u unsafe.Pointer) bool {
+	return reflect.NewAt(c.rt, u).Elem().IsZero()
+}
+
+func (c customOp) marshal(u unsafe.Pointer, s *encoder) {
+	if c.kind != customRye {
+		b := s.nextBlob()
+		s.CompactUint64(uint64(len(b)))
+		s.Slice(b)
+		return
+	}
+	size := s.nextSize()
+	s.CompactUint64(size)
+	start := s.Idx
+	if err := c.value(u).(rye.Marshaler).Marshal(s.Serializer); err != nil {
+		panic(err)
+	}
+	if wrote := uint64(s.Idx - start); wrote != size {
+		panic(fmt.Errorf("thresher: %s wrote %d bytes but MarshalSize returned %d", c.rt, wrote, size))
+	}
+}
+
+func (c customOp) unmarshal(u unsafe.Pointer, d *decoder) {
+	ln := d.CompactUint64()
+	d.stringLen(ln)
+	data := d.Slice(int(ln))
+	var err error
+	switch c.kind {
+	case customRye:
+		// unlike the encoding interfaces, rye.Unmarshaler does not require the
+		// data be copied before it is retained
+		sub := rye.NewDeserializer(append([]byte(nil), data...))
+		err = c.value(u).(rye.Unmarshaler).Unmarshal(sub)
+	case customBinary:
+		err = c.value(u).(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	case customText:
+		err = c.value(u).(encoding.TextUnmarshaler).UnmarshalText(data)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (customOp) wireType() wireType {
+	return wireBytes
+}
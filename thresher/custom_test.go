@@ -0,0 +1,267 @@
+package thresher
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+	"github.com/stretchr/testify/assert"
+)
+
+type Point struct {
+	X, Y float64
+}
+
+func (Point) MarshalSize() int { return 16 }
+
+func (p Point) Marshal(s *rye.Serializer) error {
+	s.Float64(p.X)
+	s.Float64(p.Y)
+	return nil
+}
+
+func (p *Point) Unmarshal(d *rye.Deserializer) error {
+	p.X = d.Float64()
+	p.Y = d.Float64()
+	return nil
+}
+
+type Bitmap []uint64
+
+func (b Bitmap) MarshalSize() int { return 8 * len(b) }
+
+func (b Bitmap) Marshal(s *rye.Serializer) error {
+	for _, u := range b {
+		s.Uint64(u)
+	}
+	return nil
+}
+
+func (b *Bitmap) Unmarshal(d *rye.Deserializer) error {
+	*b = make(Bitmap, len(d.Data)/8)
+	for i := range *b {
+		(*b)[i] = d.Uint64()
+	}
+	return nil
+}
+
+// Stamp is a TextMarshaler and is only encoded as text if EncodingMarshalers
+// is set.
+type Stamp struct {
+	Major int `RyeField:"1"`
+	Minor int `RyeField:"2"`
+}
+
+func (s Stamp) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(s.Major) + "." + strconv.Itoa(s.Minor)), nil
+}
+
+func (s *Stamp) UnmarshalText(b []byte) error {
+	parts := strings.SplitN(string(b), ".", 2)
+	if len(parts) != 2 {
+		return errors.New("bad stamp")
+	}
+	var err error
+	if s.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return err
+	}
+	s.Minor, err = strconv.Atoi(parts[1])
+	return err
+}
+
+type Shape struct {
+	Origin Point   `RyeField:"1"`
+	Path   []Point `RyeField:"2"`
+	Mask   Bitmap  `RyeField:"3"`
+	Corner *Point  `RyeField:"4"`
+	Stamp  Stamp   `RyeField:"5"`
+}
+
+func (*Shape) TypeID() uint64 { return 30 }
+
+type Liar struct {
+	N int
+}
+
+func (Liar) MarshalSize() int                     { return 4 }
+func (Liar) Marshal(s *rye.Serializer) error      { return errors.New("cannot marshal") }
+func (*Liar) Unmarshal(d *rye.Deserializer) error { return nil }
+
+type HasLiar struct {
+	Liar Liar `RyeField:"1"`
+}
+
+func (*HasLiar) TypeID() uint64 { return 31 }
+
+func TestCustomMarshalers(t *testing.T) {
+	s := &Shape{
+		Origin: Point{1, 2},
+		Path:   []Point{{3, 4}, {5, 6}},
+		Mask:   Bitmap{0xf0f0, 1},
+		Corner: &Point{7, 8},
+		Stamp:  Stamp{1, 2},
+	}
+
+	for _, encoding := range []bool{false, true} {
+		th := &Thresher{EncodingMarshalers: encoding}
+		assert.NoError(t, th.Register((*Shape)(nil)))
+		b, err := th.Marshal(s, nil)
+		assert.NoError(t, err)
+		i, _, err := th.Unmarshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, s, i)
+
+		schema, err := th.Schema(30)
+		assert.NoError(t, err)
+		ss := schema.Structs[schema.Type.Struct]
+		f, _ := ss.Field(1)
+		assert.Equal(t, "thresher.Point", f.Type.Custom)
+
+		d, err := DecodeDynamic(b, schema)
+		assert.NoError(t, err)
+		stamp, _ := d.(DynamicInterface).Value.(DynamicStruct).Field(5)
+		if encoding {
+			assert.Equal(t, []byte("1.2"), stamp)
+		} else {
+			assert.IsType(t, DynamicStruct{}, stamp)
+		}
+
+		encoded, err := rye.Marshal(schema)
+		assert.NoError(t, err)
+		parsed, err := ParseSchema(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, schema, parsed)
+	}
+
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*HasLiar)(nil)))
+	_, err := th.Marshal(&HasLiar{Liar{1}}, nil)
+	assert.EqualError(t, err, "cannot marshal")
+}
+
+type UUID [16]byte
+
+type uuidCodec struct{}
+
+func (uuidCodec) Size(p unsafe.Pointer) int  { return 16 }
+func (uuidCodec) Zero(p unsafe.Pointer) bool { return *(*UUID)(p) == UUID{} }
+
+func (uuidCodec) Marshal(p unsafe.Pointer, s *rye.Serializer) error {
+	s.Slice((*UUID)(p)[:])
+	return nil
+}
+
+func (uuidCodec) Unmarshal(p unsafe.Pointer, d *rye.Deserializer) error {
+	if len(d.Data) != 16 {
+		return errors.New("bad uuid")
+	}
+	copy((*UUID)(p)[:], d.Data)
+	return nil
+}
+
+type Event struct {
+	ID      UUID          `RyeField:"1"`
+	At      time.Time     `RyeField:"2"`
+	Timeout time.Duration `RyeField:"3"`
+	Amount  *big.Int      `RyeField:"4"`
+	Rate    *big.Float    `RyeField:"5"`
+	Addr    net.IP        `RyeField:"6"`
+	Peer    netip.Addr    `RyeField:"7"`
+	History []time.Time   `RyeField:"8"`
+}
+
+func (*Event) TypeID() uint64 { return 32 }
+
+func TestCodecs(t *testing.T) {
+	th := &Thresher{}
+	err := th.Register((*Event)(nil))
+	assert.Equal(t, ErrUnsupported{
+		Struct: "thresher.Event",
+		Path:   "thresher.Event.ID",
+		Kind:   reflect.Array,
+	}, err)
+
+	assert.Error(t, th.RegisterCodec(nil, uuidCodec{}))
+	assert.NoError(t, th.RegisterCodec(reflect.TypeOf(UUID{}), uuidCodec{}))
+	assert.NoError(t, th.Register((*Event)(nil)))
+
+	amount, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	e := &Event{
+		ID:      UUID{1, 2, 3, 15: 16},
+		At:      time.Unix(1600000000, 123).In(time.FixedZone("CET", 3600)),
+		Timeout: 90 * time.Second,
+		Amount:  amount,
+		Rate:    big.NewFloat(1.0 / 3).SetPrec(200),
+		Addr:    net.ParseIP("10.0.0.1"),
+		Peer:    netip.MustParseAddr("fe80::1%eth0"),
+		History: []time.Time{{}, time.Unix(0, 42).UTC()},
+	}
+	b, err := th.Marshal(e, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	got := i.(*Event)
+
+	assert.Equal(t, e.ID, got.ID)
+	assert.True(t, e.At.Equal(got.At))
+	_, offset := got.At.Zone()
+	assert.Equal(t, 3600, offset)
+	assert.Equal(t, e.Timeout, got.Timeout)
+	assert.Equal(t, 0, e.Amount.Cmp(got.Amount))
+	assert.Equal(t, 0, e.Rate.Cmp(got.Rate))
+	assert.Equal(t, e.Rate.Prec(), got.Rate.Prec())
+	assert.Equal(t, net.IP{10, 0, 0, 1}, got.Addr)
+	assert.Equal(t, e.Peer, got.Peer)
+	assert.Equal(t, []time.Time{{}, time.Unix(0, 42).UTC()}, got.History)
+
+	// zero values are not written
+	b, err = th.Marshal(&Event{}, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Event{}, i)
+
+	s, err := th.Schema(32)
+	assert.NoError(t, err)
+	f, _ := s.Structs[s.Type.Struct].Field(4)
+	assert.Equal(t, "*big.Int", f.Type.Custom)
+}
+
+func TestCodecNil(t *testing.T) {
+	type Amounts struct {
+		Ints   []*big.Int   `RyeField:"1"`
+		Floats []*big.Float `RyeField:"2"`
+	}
+	th := &Thresher{}
+	assert.NoError(t, th.RegisterNamed("amounts", (*Amounts)(nil)))
+
+	a := &Amounts{
+		Ints:   []*big.Int{big.NewInt(5), nil, new(big.Int)},
+		Floats: []*big.Float{nil, big.NewFloat(1.5), new(big.Float)},
+	}
+	b, err := th.Marshal(a, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	got := i.(*Amounts)
+
+	assert.Len(t, got.Ints, 3)
+	assert.Equal(t, int64(5), got.Ints[0].Int64())
+	assert.Nil(t, got.Ints[1])
+	assert.NotNil(t, got.Ints[2])
+	assert.Equal(t, 0, got.Ints[2].Sign())
+
+	assert.Len(t, got.Floats, 3)
+	assert.Nil(t, got.Floats[0])
+	assert.Equal(t, 0, big.NewFloat(1.5).Cmp(got.Floats[1]))
+	assert.NotNil(t, got.Floats[2])
+	assert.Equal(t, 0, got.Floats[2].Sign())
+}
@@ -0,0 +1,80 @@
+package thresher
+
+import (
+	"reflect"
+	"strconv"
+	"unsafe"
+)
+
+// fieldDefault is the value a field is given when it is not in the data. A
+// field equal to its default is not written, in place of the usual rule of not
+// writing a zero field. Only numbers and strings can have defaults.
+type fieldDefault struct {
+	value unsafe.Pointer
+	size  uintptr
+	str   bool
+}
+
+// parseDefault parses the default declared for a field of type rt. bad is
+// panicked if it cannot be parsed as rt or rt cannot have a default.
+func parseDefault(rt reflect.Type, s string, bad ErrBadTag) *fieldDefault {
+	v := reflect.New(rt).Elem()
+	switch rt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, rt.Bits())
+		if err != nil {
+			panic(bad)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, rt.Bits())
+		if err != nil {
+			panic(bad)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, rt.Bits())
+		if err != nil {
+			panic(bad)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		v.SetString(s)
+	default:
+		panic(bad)
+	}
+	return &fieldDefault{
+		value: v.Addr().UnsafePointer(),
+		size:  rt.Size(),
+		str:   rt.Kind() == reflect.String,
+	}
+}
+
+func (fd *fieldDefault) equal(u unsafe.Pointer) bool {
+	if fd.str {
+		return *(*string)(u) == *(*string)(fd.value)
+	}
+	return string(unsafe.Slice((*byte)(u), fd.size)) == string(unsafe.Slice((*byte)(fd.value), fd.size))
+}
+
+func (fd *fieldDefault) set(u unsafe.Pointer) {
+	if fd.str {
+		*(*string)(u) = *(*string)(fd.value)
+		return
+	}
+	copy(unsafe.Slice((*byte)(u), fd.size), unsafe.Slice((*byte)(fd.value), fd.size))
+}
+
+// setDefaults sets every field of the struct at base that has a default. It is
+// called before a struct that is not being merged into is decoded so fields
+// that are not in the data keep their default.
+func (sm structMarshaller) setDefaults(base unsafe.Pointer) {
+	if !sm.hasDefaults {
+		return
+	}
+	for _, f := range sm.byOrder {
+		if f.dflt != nil {
+			f.dflt.set(unsafe.Add(base, f.offset))
+		}
+	}
+}
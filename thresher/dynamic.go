@@ -0,0 +1,328 @@
+package thresher
+
+import (
+	"reflect"
+
+	"github.com/adamcolton/rye"
+)
+
+// DynamicStruct is a struct decoded by DecodeDynamic or DecodeWire. Fields are
+// in the order they were found in the data.
+type DynamicStruct struct {
+	Name   string
+	Fields []DynamicField
+}
+
+// DynamicField is a single field of a DynamicStruct. Name is empty if the field
+// was not described by a Schema.
+type DynamicField struct {
+	ID    uint64
+	Name  string
+	Value interface{}
+}
+
+// Field returns the value of the field with the given ID.
+func (ds DynamicStruct) Field(id uint64) (interface{}, bool) {
+	for _, f := range ds.Fields {
+		if f.ID == id {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ByName returns the value of the field with the given name.
+func (ds DynamicStruct) ByName(name string) (interface{}, bool) {
+	for _, f := range ds.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// DynamicInterface holds a value that was prefixed by a TypeID, either the root
+// of the data or a value stored in an interface field.
+type DynamicInterface struct {
+	TypeID uint64
+	Value  interface{}
+}
+
+// DecodeDynamic decodes data written by Thresher.Marshal into a generic tree
+// using the Schemas of the registered types rather than the Go types. The
+// result is a DynamicInterface. Structs are decoded as DynamicStruct, slices as
+// []interface{}, []byte as []byte, nil pointers and interfaces as nil and
+// other pointers as the value they point to. Signed integers are decoded as int64, unsigned
+// integers as uint64 and floats as float32 or float64. A type that encodes
+// itself is decoded as the []byte it wrote.
+//
+// The Schema for the root TypeID must be provided. If an interface holds a
+// TypeID without a Schema or a field is not in the Schema it is decoded as if
+// by DecodeWire. Data written with TrackRefs cannot be decoded with a Schema.
+// Structs and slices cannot be nested more than DefaultMaxDepth deep.
+func DecodeDynamic(data []byte, schemas ...Schema) (out interface{}, err error) {
+	defer recoverUnmarshal(&err)
+	dd := &dynamicDecoder{
+		d:       rye.NewDeserializer(data),
+		schemas: make(map[uint64]*Schema, len(schemas)),
+	}
+	for i := range schemas {
+		dd.schemas[schemas[i].TypeID] = &schemas[i]
+	}
+	tid := dd.d.CompactUint64()
+	s, found := dd.schemas[tid]
+	if !found {
+		return nil, ErrNotFound{tid}
+	}
+	out = DynamicInterface{
+		TypeID: tid,
+		Value:  dd.decode(s, s.Type, false),
+	}
+	if dd.d.Idx != len(data) {
+		return nil, ErrMalformed{"trailing data"}
+	}
+	return out, nil
+}
+
+// dynamicDecoder decodes with Schemas. depth is how deeply the value being
+// decoded is nested.
+type dynamicDecoder struct {
+	d       *rye.Deserializer
+	schemas map[uint64]*Schema
+	depth   int
+}
+
+// decode a value of type ts. Pointers that are struct fields are not prefixed
+// by a presence byte.
+func (dd *dynamicDecoder) decode(s *Schema, ts TypeSchema, field bool) interface{} {
+	d := dd.d
+	if ts.Custom != "" {
+		return append([]byte(nil), d.CompactSlice()...)
+	}
+	switch ts.Kind {
+	case reflect.Ptr:
+		if field {
+			if ts.Elem.Kind == reflect.Ptr {
+				d.CompactUint64()
+			}
+		} else if d.Byte() == 0 {
+			return nil
+		}
+		return dd.decode(s, *ts.Elem, false)
+	case reflect.Struct:
+		return dd.decodeStruct(s, s.Structs[ts.Struct])
+	case reflect.Slice:
+		if ts.Elem.Kind == reflect.Uint8 {
+			if !ts.NilSlices {
+				return append([]byte(nil), d.CompactSlice()...)
+			}
+			// a nested []byte written with NilSlices, prefixed by its byte
+			// length
+			size := d.CompactUint64()
+			if size == 0 {
+				return []byte(nil)
+			}
+			if size > uint64(len(d.Data)-d.Idx) {
+				panic(ErrMalformed{"slice length exceeds data"})
+			}
+			end := d.Idx + int(size)
+			b := append([]byte{}, d.CompactSlice()...)
+			if d.Idx != end {
+				panic(ErrMalformed{"slice length does not match contents"})
+			}
+			return b
+		}
+		if d.CompactUint64() == 0 {
+			// a nil slice written with NilSlices
+			return []interface{}(nil)
+		}
+		out := make([]interface{}, checkLen(d))
+		dd.depth = checkDepth(dd.depth+1, DefaultMaxDepth)
+		for i := range out {
+			out[i] = dd.decode(s, *ts.Elem, false)
+		}
+		dd.depth--
+		return out
+	case reflect.Interface:
+		sub := rye.NewDeserializer(d.CompactSlice())
+		if len(sub.Data) == 0 {
+			// a nil interface in a slice
+			return nil
+		}
+		tid := sub.CompactUint64()
+		di := DynamicInterface{
+			TypeID: tid,
+		}
+		if is, found := dd.schemas[tid]; found {
+			di.Value = (&dynamicDecoder{sub, dd.schemas, dd.depth}).decode(is, is.Type, false)
+		} else {
+			di.Value = decodeWireRoot(sub, dd.depth)
+		}
+		return di
+	case reflect.String:
+		return d.CompactString()
+	case reflect.Int8:
+		return int64(d.Int8())
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+		return d.CompactInt64()
+	case reflect.Uint8:
+		return uint64(d.Byte())
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return d.CompactUint64()
+	case reflect.Float32:
+		return d.Float32()
+	case reflect.Float64:
+		return d.Float64()
+	}
+	panic(ErrMalformed{"schema contains unsupported kind " + ts.Kind.String()})
+}
+
+func (dd *dynamicDecoder) decodeStruct(s *Schema, ss StructSchema) DynamicStruct {
+	out := DynamicStruct{
+		Name: ss.Name,
+	}
+	dd.depth = checkDepth(dd.depth+1, DefaultMaxDepth)
+	for {
+		header := dd.d.CompactUint64()
+		if header == 0 {
+			dd.depth--
+			return out
+		}
+		id, wt := splitHeader(header)
+		df := DynamicField{
+			ID: id,
+		}
+		if f, found := ss.Field(id); found && schemaWireType(f.Type) == wt {
+			df.Name = f.Name
+			df.Value = dd.decode(s, f.Type, true)
+		} else {
+			df.Value = decodeWire(wt, dd.d, dd.depth)
+		}
+		out.Fields = append(out.Fields, df)
+	}
+}
+
+// schemaWireType returns the wire type used for a struct field of type ts.
+func schemaWireType(ts TypeSchema) wireType {
+	if ts.Custom != "" {
+		return wireBytes
+	}
+	switch ts.Kind {
+	case reflect.Ptr:
+		if ts.Elem.Kind == reflect.Ptr {
+			return wireBytes
+		}
+		return schemaWireType(*ts.Elem)
+	case reflect.Struct:
+		return wireGroup
+	case reflect.Int8, reflect.Uint8:
+		return wireFixed8
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.Float64:
+		return wireFixed64
+	case reflect.String, reflect.Slice, reflect.Interface:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// DecodeWire decodes data written by Thresher.Marshal without a Schema, using
+// only the wire types in the field headers. The result is a DynamicInterface.
+// Groups are decoded as DynamicStruct with no field names, varints as uint64,
+// fixed width values as uint8, uint16, uint32 or uint64 and length delimited
+// values as []byte. Because the encoding of a varint does not say whether it
+// is signed, signed values will need to be converted by the caller.
+//
+// The root value is decoded as a DynamicStruct if it is a pointer to a struct,
+// nil if it is a nil pointer and []byte if it is not a pointer. A root that
+// starts with the presence byte of a pointer must be exactly one well formed
+// group, otherwise ErrMalformed is returned. Groups cannot be nested more than
+// DefaultMaxDepth deep.
+func DecodeWire(data []byte) (out interface{}, err error) {
+	defer recoverUnmarshal(&err)
+	d := rye.NewDeserializer(data)
+	tid := d.CompactUint64()
+	if d.Idx < len(d.Data) && d.Data[d.Idx] == 1 {
+		d.Idx++
+		ds := decodeWireGroup(d, 0)
+		if d.Idx != len(d.Data) {
+			return nil, ErrMalformed{"trailing data"}
+		}
+		return DynamicInterface{TypeID: tid, Value: ds}, nil
+	}
+	return DynamicInterface{
+		TypeID: tid,
+		Value:  decodeWireRoot(d, 0),
+	}, nil
+}
+
+// decodeWireRoot decodes the rest of the Deserializer as the root value of
+// a type nested depth deep. Without a Schema a pointer to a struct cannot be
+// told apart from a pointer to any other type, so a root that is not exactly
+// one well formed group is returned as []byte.
+func decodeWireRoot(d *rye.Deserializer, depth int) (out interface{}) {
+	rest := d.Data[d.Idx:]
+	d.Idx = len(d.Data)
+	if len(rest) == 1 && rest[0] == 0 {
+		return nil
+	}
+	if len(rest) > 1 && rest[0] == 1 {
+		if ds, ok := tryWireGroup(rest[1:], depth); ok {
+			return ds
+		}
+	}
+	return append([]byte(nil), rest...)
+}
+
+// tryWireGroup attempts to decode data as a group, returning false if it is not
+// exactly one well formed group. A group nested too deeply is still an error.
+func tryWireGroup(data []byte, depth int) (ds DynamicStruct, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, limit := r.(ErrLimit); limit {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	d := rye.NewDeserializer(data)
+	ds = decodeWireGroup(d, depth)
+	return ds, d.Idx == len(data)
+}
+
+func decodeWireGroup(d *rye.Deserializer, depth int) DynamicStruct {
+	var out DynamicStruct
+	depth = checkDepth(depth+1, DefaultMaxDepth)
+	for {
+		header := d.CompactUint64()
+		if header == 0 {
+			return out
+		}
+		id, wt := splitHeader(header)
+		out.Fields = append(out.Fields, DynamicField{
+			ID:    id,
+			Value: decodeWire(wt, d, depth),
+		})
+	}
+}
+
+func decodeWire(wt wireType, d *rye.Deserializer, depth int) interface{} {
+	switch wt {
+	case wireVarint:
+		return d.CompactUint64()
+	case wireFixed8:
+		return d.Byte()
+	case wireFixed16:
+		return d.Uint16()
+	case wireFixed32:
+		return d.Uint32()
+	case wireFixed64:
+		return d.Uint64()
+	case wireBytes:
+		return append([]byte(nil), d.CompactSlice()...)
+	case wireGroup:
+		return decodeWireGroup(d, depth)
+	}
+	panic(ErrWireType{uint8(wt)})
+}
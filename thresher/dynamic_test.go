@@ -0,0 +1,93 @@
+package thresher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeDynamic(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*AllTypes)(nil), (*Foo)(nil), (*A)(nil), (*B)(nil)))
+
+	iPtr := -123
+	b, err := th.Marshal(&AllTypes{
+		Int:       -1,
+		Int8:      -2,
+		Uint8:     8,
+		Uint64:    11,
+		Float32:   1.5,
+		PtrInt:    &iPtr,
+		Interface: &Foo{"a", "b"},
+	}, nil)
+	assert.NoError(t, err)
+
+	s, err := th.Schema(4)
+	assert.NoError(t, err)
+	out, err := DecodeDynamic(b, s)
+	assert.NoError(t, err)
+	v, _ := out.(DynamicInterface).Value.(DynamicStruct).ByName("Interface")
+	assert.Equal(t, uint64(3), v.(DynamicInterface).TypeID)
+	assert.IsType(t, []byte{}, v.(DynamicInterface).Value)
+	_, err = DecodeDynamic(b)
+	assert.Equal(t, ErrNotFound{4}, err)
+
+	out, err = DecodeDynamic(b, th.Schemas()...)
+	assert.NoError(t, err)
+	assert.Equal(t, DynamicInterface{
+		TypeID: 4,
+		Value: DynamicStruct{
+			Name: "thresher.AllTypes",
+			Fields: []DynamicField{
+				{ID: 1, Name: "Int", Value: int64(-1)},
+				{ID: 2, Name: "Int8", Value: int64(-2)},
+				{ID: 8, Name: "Uint8", Value: uint64(8)},
+				{ID: 11, Name: "Uint64", Value: uint64(11)},
+				{ID: 12, Name: "Float32", Value: float32(1.5)},
+				{ID: 14, Name: "PtrInt", Value: int64(-123)},
+				{ID: 15, Name: "Interface", Value: DynamicInterface{
+					TypeID: 3,
+					Value:  []interface{}{"a", "b"},
+				}},
+			},
+		},
+	}, out)
+
+	b, err = th.Marshal(&A{
+		A: 5,
+		B: &B{B: 10},
+		C: &B{B: 15},
+	}, nil)
+	assert.NoError(t, err)
+	out, err = DecodeDynamic(b, th.Schemas()...)
+	assert.NoError(t, err)
+	a := out.(DynamicInterface).Value.(DynamicStruct)
+	c, found := a.ByName("C")
+	assert.True(t, found)
+	assert.Equal(t, DynamicInterface{
+		TypeID: 7,
+		Value: DynamicStruct{
+			Name:   "thresher.B",
+			Fields: []DynamicField{{ID: 1, Name: "B", Value: int64(15)}},
+		},
+	}, c)
+
+	out, err = DecodeWire(b)
+	assert.NoError(t, err)
+	a = out.(DynamicInterface).Value.(DynamicStruct)
+	v, _ = a.Field(1)
+	assert.Equal(t, uint64(10), v) // zig-zag encoded 5
+	v, _ = a.Field(2)
+	assert.Equal(t, DynamicStruct{
+		Fields: []DynamicField{{ID: 1, Value: uint64(20)}},
+	}, v)
+	v, _ = a.Field(3)
+	assert.IsType(t, []byte{}, v)
+
+	_, err = DecodeWire(b[:3])
+	assert.Error(t, err)
+	_, err = DecodeWire(append(b[:len(b):len(b)], 0))
+	assert.Equal(t, ErrMalformed{"trailing data"}, err)
+	_, err = DecodeDynamic(b[:3], th.Schemas()...)
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrUnsupported is returned by Register when a type reachable from a
+// registered type has a kind that cannot be encoded. Struct is the struct that
+// holds the field and Path is the field path from the registered type.
+type ErrUnsupported struct {
+	Struct string
+	Path   string
+	Kind   reflect.Kind
+}
+
+func (e ErrUnsupported) Error() string {
+	if e.Struct == "" {
+		return fmt.Sprintf("thresher: unsupported kind %s at %s", e.Kind, e.Path)
+	}
+	return fmt.Sprintf("thresher: unsupported kind %s at %s in struct %s", e.Kind, e.Path, e.Struct)
+}
+
+// ErrBadTag is returned by Register when a RyeField or RyeReserved tag cannot be
+// parsed.
+type ErrBadTag struct {
+	Struct, Field, Tag string
+}
+
+func (e ErrBadTag) Error() string {
+	return fmt.Sprintf("thresher: bad tag %q on %s.%s", e.Tag, e.Struct, e.Field)
+}
+
+// ErrReserved is returned by Register when a field uses an ID that the struct
+// has reserved.
+type ErrReserved struct {
+	Struct, Field string
+	ID            uint64
+}
+
+func (e ErrReserved) Error() string {
+	return fmt.Sprintf("thresher: %s.%s uses reserved RyeField %d", e.Struct, e.Field, e.ID)
+}
+
+// ErrIncompatible is returned by Unmarshal when a field in the data has a wire
+// type that cannot be converted to the type of the field.
+type ErrIncompatible struct {
+	Struct    string
+	ID        uint64
+	Got, Want string
+}
+
+func (e ErrIncompatible) Error() string {
+	return fmt.Sprintf("thresher: RyeField %d in %s is %s, cannot decode as %s", e.ID, e.Struct, e.Got, e.Want)
+}
+
+// ErrNotFound is returned when a TypeID has not been registered.
+type ErrNotFound struct {
+	TypeID uint64
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("thresher: TypeID %d not found", e.TypeID)
+}
+
+// ErrTypeIDRedefined is returned by Register and RegisterNamed when a TypeID is
+// already in use, either by another type or because the same type is
+// registered again.
+type ErrTypeIDRedefined struct {
+	TypeID         uint64
+	Type, Existing string
+}
+
+func (e ErrTypeIDRedefined) Error() string {
+	return fmt.Sprintf("thresher: TypeID %d of %s already registered to %s", e.TypeID, e.Type, e.Existing)
+}
+
+// ErrNotRegistered is returned by Marshal and MarshalAs when a type has not
+// been registered and by UnmarshalInto when neither T nor *T has been
+// registered.
+type ErrNotRegistered struct {
+	Type string
+}
+
+func (e ErrNotRegistered) Error() string {
+	return "thresher: type " + e.Type + " not registered"
+}
+
+// ErrTypeMismatch is returned by UnmarshalInto when the data holds a different
+// type than the value it is decoded into.
+type ErrTypeMismatch struct {
+	Want, Got uint64
+}
+
+func (e ErrTypeMismatch) Error() string {
+	return fmt.Sprintf("thresher: data holds TypeID %d, expected %d", e.Got, e.Want)
+}
+
+// ErrMalformed is returned by Unmarshal when the data cannot be decoded.
+type ErrMalformed struct {
+	Reason string
+}
+
+func (e ErrMalformed) Error() string {
+	return "thresher: malformed data: " + e.Reason
+}
+
+// ErrFieldRedefined is returned by Register when two fields in a struct use
+// the same RyeField ID. Fields promoted from flattened embedded structs share
+// the ID space of the struct embedding them, so either field may come from an
+// embedded struct.
+type ErrFieldRedefined struct {
+	Struct string
+	ID     uint64
+	// Field and Previous name the two fields using ID.
+	Field, Previous string
+}
+
+func (e ErrFieldRedefined) Error() string {
+	return fmt.Sprintf("thresher: RyeField %d redefined in %s by %s, already used by %s", e.ID, e.Struct, e.Field, e.Previous)
+}
+
+// ErrRequired is returned by Unmarshal when fields with the required option
+// are not in the data. Fields holds the path of each missing field from the
+// root value, such as "Order.Items[3].SKU".
+type ErrRequired struct {
+	Fields []string
+}
+
+func (e ErrRequired) Error() string {
+	return "thresher: missing required " + strings.Join(e.Fields, ", ")
+}
+
+func (e ErrRequired) withPath(p string) error {
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = p + f
+	}
+	return ErrRequired{fields}
+}
+
+// ErrInvalid is returned by Unmarshal when the Validate method of a decoded
+// value returns an error. Path is the path of the value from the root value,
+// such as "Order.Items[3]".
+type ErrInvalid struct {
+	Path string
+	Err  error
+}
+
+func (e ErrInvalid) Error() string {
+	return fmt.Sprintf("thresher: invalid %s: %s", e.Path, e.Err)
+}
+
+func (e ErrInvalid) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrInvalid) withPath(p string) error {
+	e.Path = p + e.Path
+	return e
+}
+
+// ErrUnknownField is returned by Projection when a path does not name a
+// field. Path starts with the registered type, such as
+// "thresher.Order.Items[].Qty".
+type ErrUnknownField struct {
+	Path string
+}
+
+func (e ErrUnknownField) Error() string {
+	return "thresher: no field " + e.Path
+}
+
+// ErrNoField is returned by Patch when a struct has no field with the ID.
+type ErrNoField struct {
+	Struct string
+	ID     uint64
+}
+
+func (e ErrNoField) Error() string {
+	return fmt.Sprintf("thresher: %s has no RyeField %d", e.Struct, e.ID)
+}
+
+// ErrSkipRefs is returned by Unmarshal when tracking references and the data
+// holds a field that the struct does not have. The writer numbered the
+// pointers in the field, so the reader cannot skip it without resolving every
+// later reference to the wrong pointer.
+type ErrSkipRefs struct {
+	Struct string
+	ID     uint64
+}
+
+func (e ErrSkipRefs) Error() string {
+	return fmt.Sprintf("thresher: cannot skip RyeField %d of %s when tracking references", e.ID, e.Struct)
+}
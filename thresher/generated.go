@@ -0,0 +1,213 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+// Generated is implemented by the methods cmd/ryegen writes for a struct with
+// RyeField tags. They use the same wire format as encoding the struct by
+// reflection, a group, so the Thresher calls them in place of reflection to
+// encode without changing the data. The struct is still compiled by reflection
+// so that its fields are checked, it has a Schema and it can be decoded: the
+// generated Unmarshal method cannot enforce the Limits of a Thresher, so it is
+// only used when the methods are called directly.
+//
+// Generated methods do not track references, keep nil and empty slices apart
+// or follow WriteZero, so they are not used when TrackRefs, NilSlices or
+// WriteZero is set. They also do not know about a Codec or a type that encodes
+// itself, so they are not used for a struct that has a field encoded by one,
+// even through a pointer, slice or nested struct. They can also be turned off
+// with IgnoreGenerated, which is how the tests written by ryegen compare the
+// two.
+type Generated interface {
+	rye.Marshaler
+	// Unmarshal decodes into a zero value; fields that are not in the data
+	// are left zero or set to their default.
+	rye.Unmarshaler
+	// RyeZero reports whether every field that is encoded is zero. A struct
+	// field that is zero is not written.
+	RyeZero() bool
+}
+
+var generatedType = reflect.TypeOf((*Generated)(nil)).Elem()
+
+// generated reports if the Generated methods of rt should be used.
+func (t *Thresher) generated(rt reflect.Type) bool {
+	return !t.IgnoreGenerated && !t.TrackRefs && !t.NilSlices && !t.WriteZero && rt.Kind() == reflect.Struct &&
+		reflect.PtrTo(rt).Implements(generatedType)
+}
+
+// checkGenerated decides for each struct in pendingGenerated whether its
+// Generated methods are used. It is called once the whole type graph of a
+// type has been compiled so that recursive structs are seen in full.
+func (c *compiler) checkGenerated() {
+	for _, sm := range c.pendingGenerated {
+		sm.generated = !encodesSelf(sm, make(map[*structMarshaller]bool))
+	}
+	c.pendingGenerated = nil
+}
+
+// encodesSelf reports whether op uses a Codec or a customOp anywhere the
+// Generated methods of a struct would encode it.
+func encodesSelf(op uintPtrOp, seen map[*structMarshaller]bool) bool {
+	switch o := op.(type) {
+	case codecOp, customOp:
+		return true
+	case ptrMarshaller:
+		return encodesSelf(o.op, seen)
+	case ptrFieldMarshaller:
+		return encodesSelf(o.op, seen)
+	case sliceMarshaller:
+		return encodesSelf(o.op, seen)
+	case delimited:
+		return encodesSelf(o.op, seen)
+	case lazyOp:
+		return encodesSelf(o.op, seen)
+	case generatedOp:
+		return encodesSelf(o.sm, seen)
+	case *structMarshaller:
+		if seen[o] {
+			return false
+		}
+		seen[o] = true
+		for _, f := range o.byOrder {
+			if encodesSelf(f.uintPtrOp, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generatedOp delegates encoding to the Generated methods of a struct. Unlike
+// customOp the value is not prefixed with its length because a group is self
+// delimiting. The struct is always decoded by reflection so that Limits, Merge
+// and the checks apply to it as to any other struct, and it is encoded by
+// reflection too if the Generated methods cannot be used.
+type generatedOp struct {
+	rt reflect.Type
+	sm *structMarshaller
+}
+
+func (g generatedOp) value(u unsafe.Pointer) Generated {
+	return reflect.NewAt(g.rt, u).Interface().(Generated)
+}
+
+func (g generatedOp) size(u unsafe.Pointer, s *encoder) int {
+	if !g.sm.generated {
+		return g.sm.size(u, s)
+	}
+	return g.value(u).MarshalSize()
+}
+
+func (g generatedOp) zero(u unsafe.Pointer) bool {
+	if !g.sm.generated {
+		return g.sm.zero(u)
+	}
+	return g.value(u).RyeZero()
+}
+
+func (g generatedOp) marshal(u unsafe.Pointer, s *encoder) {
+	if !g.sm.generated {
+		g.sm.marshal(u, s)
+		return
+	}
+	if err := g.value(u).Marshal(s.Serializer); err != nil {
+		panic(err)
+	}
+}
+
+func (g generatedOp) unmarshal(u unsafe.Pointer, d *decoder) {
+	g.sm.unmarshal(u, d)
+}
+
+func (generatedOp) wireType() wireType {
+	return wireGroup
+}
+
+// SkipField is called by the Unmarshal method written by cmd/ryegen for a
+// field header it does not decode. headers are the field headers of the
+// struct; if one has the same ID the field cannot be decoded and
+// ErrIncompatible is returned. Otherwise the field is skipped. Unlike
+// reflection, generated methods do not widen a field written with a narrower
+// type.
+func SkipField(structName string, headers []uint64, header uint64, d *rye.Deserializer) error {
+	id, wt := splitHeader(header)
+	for _, h := range headers {
+		if known, want := splitHeader(h); known == id {
+			return ErrIncompatible{
+				Struct: structName,
+				ID:     id,
+				Got:    wt.String(),
+				Want:   want.String(),
+			}
+		}
+	}
+	if wt >= wireTypeLimit {
+		return ErrWireType{uint8(wt)}
+	}
+	skipWire(wt, d, 0, DefaultMaxDepth)
+	return nil
+}
+
+// SliceLen is called by the Unmarshal method written by cmd/ryegen to read the
+// length prefix and element count of a slice. A length prefix of 0, which is
+// how NilSlices writes a nil slice, has no count and returns 0. A count over
+// DefaultSliceThreshold is ErrLimit, and as every element uses at least one
+// byte a count larger than the remaining data is rejected before the slice is
+// allocated.
+func SliceLen(d *rye.Deserializer) (int, error) {
+	if d.CompactUint64() == 0 {
+		return 0, nil
+	}
+	ln := d.CompactUint64()
+	if ln > DefaultSliceThreshold {
+		return 0, ErrLimit{"MaxSliceLen", ln, DefaultSliceThreshold}
+	}
+	if ln > uint64(len(d.Data)-d.Idx) {
+		return 0, ErrMalformed{"slice length exceeds data"}
+	}
+	return int(ln), nil
+}
+
+// MissingFields is called by the Unmarshal method written by cmd/ryegen when a
+// required field was not in the data. fields are the names of the required
+// fields in order and seen has bit i set if field i was decoded.
+func MissingFields(fields []string, seen uint64) error {
+	var missing []string
+	for i, f := range fields {
+		if seen&(1<<i) == 0 {
+			missing = append(missing, "."+f)
+		}
+	}
+	return ErrRequired{missing}
+}
+
+// Validate is called by the Unmarshal method written by cmd/ryegen once a
+// struct is decoded. If v implements Validator and Validate fails the error is
+// returned as ErrInvalid.
+func Validate(v interface{}) error {
+	if vr, ok := v.(Validator); ok {
+		if err := vr.Validate(); err != nil {
+			return ErrInvalid{Err: err}
+		}
+	}
+	return nil
+}
+
+// WithField adds the name of a field to the path of an error returned by
+// Unmarshal for a value in that field. Errors without a path are returned
+// unchanged.
+func WithField(err error, name string) error {
+	return prefixPath(err, "."+name).(error)
+}
+
+// WithIndex adds the index of a slice element to the path of an error returned
+// by Unmarshal for that element. Errors without a path are returned unchanged.
+func WithIndex(err error, i int) error {
+	return prefixPath(err, fmt.Sprintf("[%d]", i)).(error)
+}
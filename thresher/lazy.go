@@ -0,0 +1,145 @@
+package thresher
+
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+// Lazy holds a value that is decoded when it is first used. Unmarshal keeps a
+// copy of the encoded value instead of decoding it, and if the value is never
+// used Marshal writes those bytes back out unchanged, so a Lazy field can
+// forward a value it never looks at for little more than the cost of the copy.
+//
+// Lazy is encoded the same way as T, so a field can be changed between T and
+// Lazy[T] without changing the data or the Schema. T cannot be a pointer or an
+// interface and Lazy cannot be used when tracking references. Like any other
+// value a Lazy must not be used from more than one goroutine at a time.
+type Lazy[T any] struct {
+	lazyState
+	value T
+}
+
+// Get returns the value, decoding it the first time it is called after
+// Unmarshal. An error is returned if it cannot be decoded, in which case Get
+// can be called again and Marshal still writes the original bytes.
+func (l *Lazy[T]) Get() (T, error) {
+	if l.raw != nil {
+		if err := l.decode(unsafe.Pointer(&l.value)); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	return l.value, nil
+}
+
+// Set replaces the value, discarding any encoded value that has not been
+// decoded.
+func (l *Lazy[T]) Set(v T) {
+	l.lazyState = lazyState{}
+	l.value = v
+}
+
+func (*Lazy[T]) lazyElem() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// lazy is implemented by *Lazy[T].
+type lazy interface {
+	lazyElem() reflect.Type
+}
+
+var lazyType = reflect.TypeOf((*lazy)(nil)).Elem()
+
+// lazyElem returns T if rt is Lazy[T].
+func lazyElem(rt reflect.Type) (reflect.Type, bool) {
+	if rt.Kind() != reflect.Struct || !reflect.PtrTo(rt).Implements(lazyType) {
+		return nil, false
+	}
+	return reflect.New(rt).Interface().(lazy).lazyElem(), true
+}
+
+var errLazyRefs = errors.New("thresher: Lazy cannot be used when tracking references")
+
+// lazyState is the part of a Lazy that does not depend on T. While raw is set
+// it holds the encoded value and what is needed to decode it.
+type lazyState struct {
+	raw    []byte
+	op     uintPtrOp
+	reg    *registry
+	limits Limits
+}
+
+// decode unmarshals raw into the value at p.
+func (ls *lazyState) decode(p unsafe.Pointer) (err error) {
+	defer recoverUnmarshal(&err)
+	d := &decoder{
+		Deserializer: rye.NewDeserializer(ls.raw),
+		reg:          ls.reg,
+		limits:       ls.limits,
+		checks:       ls.reg.checks,
+	}
+	ls.op.unmarshal(p, d)
+	*ls = lazyState{}
+	return nil
+}
+
+func (t *compiler) compileLazy(rt, elem reflect.Type, p fieldPath) lazyOp {
+	if t.TrackRefs {
+		panic(errLazyRefs)
+	}
+	if k := elem.Kind(); k == reflect.Ptr || k == reflect.Interface {
+		panic(p.unsupported(k))
+	}
+	return lazyOp{
+		op:     t.compile(elem, p),
+		elem:   elem,
+		offset: rt.Field(1).Offset,
+	}
+}
+
+// lazyOp encodes a Lazy[T]. The extent of the encoded value is found from its
+// wire type, as when skipping a field, so it can be kept without decoding it.
+type lazyOp struct {
+	op     uintPtrOp
+	elem   reflect.Type
+	offset uintptr
+}
+
+func (l lazyOp) size(u unsafe.Pointer, s *encoder) int {
+	if raw := (*lazyState)(u).raw; raw != nil {
+		return len(raw)
+	}
+	return l.op.size(unsafe.Add(u, l.offset), s)
+}
+
+func (l lazyOp) zero(u unsafe.Pointer) bool {
+	return (*lazyState)(u).raw == nil && l.op.zero(unsafe.Add(u, l.offset))
+}
+
+func (l lazyOp) marshal(u unsafe.Pointer, s *encoder) {
+	if raw := (*lazyState)(u).raw; raw != nil {
+		s.Slice(raw)
+		return
+	}
+	l.op.marshal(unsafe.Add(u, l.offset), s)
+}
+
+func (l lazyOp) unmarshal(u unsafe.Pointer, d *decoder) {
+	start := d.Idx
+	d.skip(l.op.wireType())
+	d.alloc(uint64(d.Idx - start))
+	reflect.NewAt(l.elem, unsafe.Add(u, l.offset)).Elem().SetZero()
+	*(*lazyState)(u) = lazyState{
+		raw:    append([]byte(nil), d.Data[start:d.Idx]...),
+		op:     l.op,
+		reg:    d.reg,
+		limits: d.limits,
+	}
+}
+
+func (l lazyOp) wireType() wireType {
+	return l.op.wireType()
+}
@@ -0,0 +1,98 @@
+package thresher
+
+import (
+	"fmt"
+)
+
+// DefaultMaxDepth is the nesting depth used when Limits.MaxDepth is 0.
+const DefaultMaxDepth = 1000
+
+// Limits bounds the resources used by Unmarshal so that untrusted data cannot
+// cause a large allocation or exhaust the stack. A limit of 0 uses the default.
+// Marshal also returns ErrLimit for a slice longer than MaxSliceLen so that a
+// Thresher can always read what it writes, except for a slice in a struct
+// encoded by its Generated methods, which only check DefaultSliceThreshold
+// when they decode.
+type Limits struct {
+	// MaxSliceLen is the most elements allowed in a slice, not including []byte.
+	// The default is DefaultSliceThreshold.
+	MaxSliceLen uint64
+	// MaxStringLen is the longest string or []byte allowed. By default these are
+	// only limited by the length of the data.
+	MaxStringLen uint64
+	// MaxAlloc is the total number of bytes that can be allocated for slices,
+	// strings and pointers in a single call to Unmarshal. By default there is
+	// no limit.
+	MaxAlloc uint64
+	// MaxDepth is how deeply structs and slices can be nested. The default is
+	// DefaultMaxDepth.
+	MaxDepth int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxSliceLen == 0 {
+		l.MaxSliceLen = DefaultSliceThreshold
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = DefaultMaxDepth
+	}
+	return l
+}
+
+// ErrLimit is returned by Unmarshal when data exceeds one of the Limits and by
+// Marshal when a slice is longer than MaxSliceLen.
+type ErrLimit struct {
+	Limit      string
+	Value, Max uint64
+}
+
+func (e ErrLimit) Error() string {
+	return fmt.Sprintf("thresher: %s exceeded: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// sliceLen checks the number of elements in a slice. Every element uses at
+// least one byte so the length can never exceed the remaining data.
+func (d *decoder) sliceLen(ln uint64) {
+	if ln > d.limits.MaxSliceLen {
+		panic(ErrLimit{"MaxSliceLen", ln, d.limits.MaxSliceLen})
+	}
+	if ln > uint64(len(d.Data)-d.Idx) {
+		panic(ErrMalformed{"slice length exceeds data"})
+	}
+}
+
+// stringLen checks the length of a string or []byte.
+func (d *decoder) stringLen(ln uint64) {
+	if d.limits.MaxStringLen > 0 && ln > d.limits.MaxStringLen {
+		panic(ErrLimit{"MaxStringLen", ln, d.limits.MaxStringLen})
+	}
+	if ln > uint64(len(d.Data)-d.Idx) {
+		panic(ErrMalformed{"length exceeds data"})
+	}
+	d.alloc(ln)
+}
+
+// alloc records an allocation of n bytes.
+func (d *decoder) alloc(n uint64) {
+	d.allocated += n
+	if d.limits.MaxAlloc > 0 && d.allocated > d.limits.MaxAlloc {
+		panic(ErrLimit{"MaxAlloc", d.allocated, d.limits.MaxAlloc})
+	}
+}
+
+// enter is called when decoding a struct or slice and exit when it is done.
+func (d *decoder) enter() {
+	d.depth = checkDepth(d.depth+1, d.limits.MaxDepth)
+}
+
+func (d *decoder) exit() {
+	d.depth--
+}
+
+// checkDepth returns depth if it is within maxDepth.
+func checkDepth(depth, maxDepth int) int {
+	if depth > maxDepth {
+		panic(ErrLimit{"MaxDepth", uint64(depth), uint64(maxDepth)})
+	}
+	return depth
+}
@@ -2,12 +2,44 @@ package thresher
 
 import (
 	"reflect"
+	"unsafe"
 )
 
 type structField struct {
 	offset uintptr
 	uintPtrOp
 	fieldHeader uint64
+	name        string
+	rt          reflect.Type
+	// always writes the field even if it is zero.
+	always bool
+	dflt   *fieldDefault
+	// required numbers the fields with the required option from 1.
+	required int
+}
+
+// requiredBit is the bit for the field in the set of required fields that
+// were decoded.
+func (f structField) requiredBit() uint64 {
+	if f.required == 0 {
+		return 0
+	}
+	return 1 << (f.required - 1)
+}
+
+// omit reports whether the field at u is not written, either because it is
+// zero or because it is equal to its default.
+func (f structField) omit(u unsafe.Pointer) bool {
+	if f.fieldHeader == 0 {
+		return true
+	}
+	if f.always {
+		return false
+	}
+	if f.dflt != nil {
+		return f.dflt.equal(u)
+	}
+	return f.zero(u)
 }
 
 type ptrMarshaller struct {
@@ -15,22 +47,45 @@ type ptrMarshaller struct {
 	t  reflect.Type
 }
 
+// ptrFieldMarshaller is used when a pointer is a struct field. A nil pointer
+// is never written so no presence byte is needed.
+type ptrFieldMarshaller ptrMarshaller
+
 type structMarshaller struct {
-	byOrder []structField
-	byId    []structField
+	byOrder    []structField
+	byId       []structField
+	unknown    uintptr
+	hasUnknown bool
+	rt         reflect.Type
+	reserved   []uint64
+	// hasDefaults is set if any field has a default.
+	hasDefaults bool
+	// required is the number of fields with the required option.
+	required int
+	// validate is set if the struct implements Validator.
+	validate bool
+	// generated is set if the Generated methods of the struct are used to
+	// encode it.
+	generated bool
 }
 
 type marshaller struct {
 	op uintPtrOp
 	t  reflect.Type
+	// direct is true if a value of t is stored in the data word of an
+	// interface.
+	direct bool
 }
 
 type sliceMarshaller struct {
 	op        uintPtrOp
 	recordLen uintptr
+	rt        reflect.Type
+	// nilSlices writes a nil slice with a byte length of 0 and decodes an
+	// empty slice as empty rather than nil.
+	nilSlices bool
 }
 
 type interfaceMarshaller struct {
-	t  *Thresher
 	rt reflect.Type
 }
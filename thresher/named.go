@@ -0,0 +1,26 @@
+package thresher
+
+import (
+	"hash/fnv"
+	"reflect"
+)
+
+// NamedID returns the TypeID RegisterNamed uses for name. It is the 32 bit
+// FNV-1a hash of the name above 1<<32 so that it cannot collide with a
+// hand-picked TypeID below that and is written in 5 bytes.
+func NamedID(name string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return 1<<32 | uint64(h.Sum32())
+}
+
+// RegisterNamed registers the type of v with the TypeID derived from name by
+// NamedID, so the ID is stable as long as the name is. v does not need to
+// implement HasType, which allows registering types from other packages. Names
+// should be unique, such as "pkg.Person"; if two names hash to the same TypeID
+// ErrTypeIDRedefined is returned and one of them must be renamed.
+func (t *Thresher) RegisterNamed(name string, v interface{}) error {
+	return t.update(func(c *compiler) {
+		c.add(NamedID(name), reflect.TypeOf(v))
+	})
+}
@@ -0,0 +1,127 @@
+package thresher
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/adamcolton/rye"
+)
+
+var errPatchRefs = errors.New("thresher: data cannot be patched when tracking references")
+
+// Patch returns a copy of data with the top level field fieldID of the struct
+// registered with typeID set to value, without decoding the rest of the data.
+// The field is replaced if it is in the data and added otherwise; if value is
+// nil or would not be written by Marshal, such as a zero value, the field is
+// removed. The type of value must be assignable to the field. Fields that are
+// not known, including those kept in UnknownFields, are copied unchanged. The
+// result is the same as decoding the data, setting the field and encoding it
+// again, except that required fields and Validate are not checked because the
+// value is never decoded. TrackRefs cannot be used with Patch because the
+// field could refer to pointers elsewhere in the data.
+func (t *Thresher) Patch(data []byte, typeID, fieldID uint64, value interface{}) (out []byte, err error) {
+	defer recoverUnmarshal(&err)
+	if t.TrackRefs {
+		return nil, errPatchRefs
+	}
+	reg := t.load()
+	m := reg.marshaller(typeID)
+	if m == nil {
+		return nil, ErrNotFound{typeID}
+	}
+	sm, ptr := patchStruct(m.op)
+	if sm == nil {
+		return nil, fmt.Errorf("thresher: %s is not a struct", m.t)
+	}
+	sf, order := sm.fieldByID(fieldID)
+	if order < 0 {
+		return nil, ErrNoField{Struct: sm.rt.String(), ID: fieldID}
+	}
+	field := encodeField(reg, t.Limits, sf, value)
+
+	d := rye.NewDeserializer(data)
+	if got := d.CompactUint64(); got != typeID {
+		return nil, ErrTypeMismatch{Want: typeID, Got: got}
+	}
+	if ptr && d.Byte() == 0 {
+		return nil, fmt.Errorf("thresher: cannot patch a nil %s", m.t)
+	}
+	// Find the field to replace, or where Marshal would have written it: before
+	// the first field that comes after it, an unknown field or the end.
+	start, end := -1, -1
+	maxDepth := t.Limits.withDefaults().MaxDepth
+	for {
+		idx := d.Idx
+		header := d.CompactUint64()
+		if header == 0 {
+			if start < 0 {
+				start, end = idx, idx
+			}
+			break
+		}
+		id, wt := splitHeader(header)
+		skipWire(wt, d, 1, maxDepth)
+		if id == fieldID {
+			start, end = idx, d.Idx
+		} else if _, o := sm.fieldByID(id); start < 0 && (o < 0 || o > order) {
+			start, end = idx, idx
+		}
+	}
+
+	out = make([]byte, 0, len(data)-(end-start)+len(field))
+	out = append(out, data[:start]...)
+	out = append(out, field...)
+	return append(out, data[end:]...), nil
+}
+
+// patchStruct returns the struct encoded by the root op, and whether it is
+// behind a pointer.
+func patchStruct(op uintPtrOp) (*structMarshaller, bool) {
+	ptr := false
+	if p, ok := op.(ptrMarshaller); ok {
+		op, ptr = p.op, true
+	}
+	switch o := op.(type) {
+	case *structMarshaller:
+		return o, ptr
+	case generatedOp:
+		return o.sm, ptr
+	}
+	return nil, false
+}
+
+// fieldByID returns the field with the given ID and its position in byOrder,
+// which is -1 if there is no such field.
+func (sm structMarshaller) fieldByID(id uint64) (structField, int) {
+	for i, f := range sm.byOrder {
+		if f.fieldHeader != 0 {
+			if fid, _ := splitHeader(f.fieldHeader); fid == id {
+				return f, i
+			}
+		}
+	}
+	return structField{}, -1
+}
+
+// encodeField returns the header and value of the field set to v, or nil if
+// the field would not be written.
+func encodeField(reg *registry, l Limits, sf structField, v interface{}) []byte {
+	rv := reflect.New(sf.rt)
+	if v != nil {
+		vv := reflect.ValueOf(v)
+		if !vv.Type().AssignableTo(sf.rt) {
+			panic(fmt.Errorf("thresher: cannot set field %s of type %s to %s", sf.name, sf.rt, vv.Type()))
+		}
+		rv.Elem().Set(vv)
+	}
+	u := rv.UnsafePointer()
+	if sf.omit(u) {
+		return nil
+	}
+	s := newEncoder(reg, false, l)
+	s.startWrite(rye.CompactUint64Size(sf.fieldHeader)+sf.size(u, s), nil)
+	s.CompactUint64(sf.fieldHeader)
+	sf.marshal(u, s)
+	return s.Data
+}
@@ -0,0 +1,30 @@
+package thresher
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// TestPortable runs the tests of this package again for GOARCH=386 with checkptr
+// enabled so that assumptions about the size or layout of pointers, slices and
+// interfaces fail in a normal test run. It needs a linux/amd64 host to run the
+// 386 binary and is skipped with -short.
+func TestPortable(t *testing.T) {
+	if testing.Short() || os.Getenv("THRESHER_PORTABLE") != "" {
+		t.Skip("skipped in short mode and in the child test run")
+	}
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("386 binaries are only run on linux/amd64")
+	}
+	gotool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	cmd := exec.Command(gotool, "test", "-count=1", "-gcflags=-d=checkptr", ".")
+	cmd.Env = append(os.Environ(), "GOARCH=386", "CGO_ENABLED=0", "THRESHER_PORTABLE=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("GOARCH=386 go test: %v\n%s", err, out)
+	}
+}
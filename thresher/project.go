@@ -0,0 +1,173 @@
+package thresher
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/adamcolton/rye"
+)
+
+// Projection decodes only some of the fields of a registered struct. Fields
+// that are not selected are skipped without being decoded, so a Projection
+// built once is a cheap way to read a few fields from many records. A
+// Projection uses the types registered when it was created.
+type Projection struct {
+	t      *Thresher
+	reg    *registry
+	typeID uint64
+	m      *marshaller
+}
+
+// selection is a tree of selected fields. A field with no fields of its own is
+// selected entirely.
+type selection map[string]selection
+
+var errProjectRefs = errors.New("thresher: fields cannot be projected when tracking references")
+
+// Projection returns a Projection of the type registered with typeID that
+// decodes the fields named by paths. A path is a field name, or a dotted path
+// such as "Address.City" to select a field of a nested struct; a path through
+// a pointer or a slice selects the field of each struct it holds. Fields are
+// named as in Go, and the fields of flattened embedded structs by their own
+// names. Defaults are set on selected fields that are not in the data, but
+// required fields and Validate are not checked because the value is
+// incomplete. With no paths every field is decoded. TrackRefs cannot be used
+// with a Projection because skipping a value would change the IDs of the
+// references after it.
+func (t *Thresher) Projection(typeID uint64, paths ...string) (p *Projection, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = toErr(r)
+		}
+	}()
+	if t.TrackRefs {
+		return nil, errProjectRefs
+	}
+	reg := t.load()
+	m := reg.marshaller(typeID)
+	if m == nil {
+		return nil, ErrNotFound{typeID}
+	}
+	sel := selection{}
+	for _, path := range paths {
+		sel.add(strings.Split(path, "."))
+	}
+	return &Projection{
+		t:      t,
+		reg:    reg,
+		typeID: typeID,
+		m: &marshaller{
+			op: project(m.op, sel, rootPath(m.t).path),
+			t:  m.t,
+		},
+	}, nil
+}
+
+// add selects the field at path. Selecting a field entirely replaces any
+// fields selected within it.
+func (s selection) add(path []string) {
+	sub, found := s[path[0]]
+	if len(path) == 1 || (found && len(sub) == 0) {
+		s[path[0]] = selection{}
+		return
+	}
+	if sub == nil {
+		sub = selection{}
+		s[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// project returns op decoding only the fields in sel. path is used to name a
+// field that does not exist.
+func project(op uintPtrOp, sel selection, path string) uintPtrOp {
+	if len(sel) == 0 {
+		return op
+	}
+	switch o := op.(type) {
+	case *structMarshaller:
+		return projectStruct(o, sel, path)
+	case generatedOp:
+		// generated structs are decoded by reflection
+		return projectStruct(o.sm, sel, path)
+	case ptrMarshaller:
+		o.op = project(o.op, sel, path)
+		return o
+	case ptrFieldMarshaller:
+		o.op = project(o.op, sel, path)
+		return o
+	case sliceMarshaller:
+		o.op = project(o.op, sel, path+"[]")
+		return o
+	}
+	for name := range sel {
+		panic(ErrUnknownField{path + "." + name})
+	}
+	return op
+}
+
+// projectStruct copies sm with only the fields in sel. The fields that are
+// left out have no header in byId so they are skipped.
+func projectStruct(sm *structMarshaller, sel selection, path string) *structMarshaller {
+	out := &structMarshaller{
+		byId: make([]structField, len(sm.byId)),
+		rt:   sm.rt,
+	}
+	for name, sub := range sel {
+		found := false
+		for _, f := range sm.byOrder {
+			if f.fieldHeader == 0 || f.name != name {
+				continue
+			}
+			found = true
+			f.uintPtrOp = project(f.uintPtrOp, sub, path+"."+name)
+			f.required = 0
+			out.byOrder = append(out.byOrder, f)
+			id, _ := splitHeader(f.fieldHeader)
+			out.byId[id] = f
+			if f.dflt != nil {
+				out.hasDefaults = true
+			}
+		}
+		if !found {
+			panic(ErrUnknownField{path + "." + name})
+		}
+	}
+	return out
+}
+
+// Unmarshal decodes the selected fields of data, which must hold the type of
+// the Projection. The value returned has the registered type, like
+// Thresher.Unmarshal, with the fields that were not selected left zero.
+func (p *Projection) Unmarshal(data []byte) (i interface{}, err error) {
+	defer recoverUnmarshal(&err)
+	d := newDecoder(data, p.t, p.reg)
+	if got := d.CompactUint64(); got != p.typeID {
+		return nil, ErrTypeMismatch{Want: p.typeID, Got: got}
+	}
+	r := reflect.New(p.m.t)
+	p.m.op.unmarshal(r.UnsafePointer(), d)
+	return r.Elem().Interface(), nil
+}
+
+// UnmarshalFields decodes only the fields named by paths; see Projection for
+// how they are named. The Projection is built on each call, so to decode many
+// records create one with Thresher.Projection instead.
+func (t *Thresher) UnmarshalFields(data []byte, paths ...string) (interface{}, error) {
+	typeID, err := peekTypeID(data)
+	if err != nil {
+		return nil, err
+	}
+	p, err := t.Projection(typeID, paths...)
+	if err != nil {
+		return nil, err
+	}
+	return p.Unmarshal(data)
+}
+
+// peekTypeID reads the TypeID at the start of data.
+func peekTypeID(data []byte) (typeID uint64, err error) {
+	defer recoverUnmarshal(&err)
+	return rye.NewDeserializer(data).CompactUint64(), nil
+}
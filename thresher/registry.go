@@ -0,0 +1,133 @@
+package thresher
+
+import (
+	"reflect"
+	"sort"
+)
+
+// TypeIDs below maxDenseID are looked up by index in a slice that grows by
+// doubling from minDense. Larger TypeIDs, such as those from RegisterNamed,
+// are kept in a map so a single large ID does not allocate a huge slice.
+const (
+	minDense   = 256
+	maxDenseID = 1 << 12
+)
+
+// registry holds everything compiled by Register. Once a registry has been
+// published by a Thresher it is never modified; Register and RegisterCodec
+// clone it, change the clone and swap it in so Marshal and Unmarshal can use it
+// without locking.
+type registry struct {
+	typedIDMarshallers []*marshaller
+	// sparse holds TypeIDs of at least maxDenseID.
+	sparse            map[uint64]*marshaller
+	structMarshallers map[reflect.Type]*structMarshaller
+	codecs            map[reflect.Type]Codec
+	// byType is the TypeID each type was registered with.
+	byType map[reflect.Type]uint64
+	// checks is set if any struct has required fields or a Validate method,
+	// so decoding records the path to errors.
+	checks bool
+}
+
+var emptyRegistry = &registry{}
+
+func (r *registry) clone() *registry {
+	out := &registry{
+		typedIDMarshallers: append([]*marshaller(nil), r.typedIDMarshallers...),
+		sparse:             make(map[uint64]*marshaller, len(r.sparse)),
+		structMarshallers:  make(map[reflect.Type]*structMarshaller, len(r.structMarshallers)),
+		codecs:             make(map[reflect.Type]Codec, len(r.codecs)),
+		byType:             make(map[reflect.Type]uint64, len(r.byType)),
+		checks:             r.checks,
+	}
+	for k, v := range r.sparse {
+		out.sparse[k] = v
+	}
+	for k, v := range r.structMarshallers {
+		out.structMarshallers[k] = v
+	}
+	for k, v := range r.codecs {
+		out.codecs[k] = v
+	}
+	for k, v := range r.byType {
+		out.byType[k] = v
+	}
+	return out
+}
+
+// marshaller returns the marshaller for a TypeID or nil if it is not
+// registered.
+func (r *registry) marshaller(typeID uint64) *marshaller {
+	if typeID >= uint64(len(r.typedIDMarshallers)) {
+		return r.sparse[typeID]
+	}
+	return r.typedIDMarshallers[typeID]
+}
+
+// typeIDs returns every registered TypeID in ascending order.
+func (r *registry) typeIDs() []uint64 {
+	var ids []uint64
+	for id, m := range r.typedIDMarshallers {
+		if m != nil {
+			ids = append(ids, uint64(id))
+		}
+	}
+	start := len(ids)
+	for id := range r.sparse {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids[start:], func(i, j int) bool { return ids[start+i] < ids[start+j] })
+	return ids
+}
+
+// lookupType returns the TypeID and marshaller of pt, which must be a pointer
+// type, or of its element if that was registered instead. ptr is true if pt
+// itself was registered. The marshaller is nil if neither was registered.
+func (r *registry) lookupType(pt reflect.Type) (id uint64, m *marshaller, ptr bool) {
+	if id, found := r.byType[pt]; found {
+		return id, r.marshaller(id), true
+	}
+	if id, found := r.byType[pt.Elem()]; found {
+		return id, r.marshaller(id), false
+	}
+	return 0, nil, false
+}
+
+// load returns the current registry.
+func (t *Thresher) load() *registry {
+	if r := t.reg.Load(); r != nil {
+		return r
+	}
+	return emptyRegistry
+}
+
+// compiler compiles types into a registry that has not been published.
+type compiler struct {
+	*Thresher
+	*registry
+	// pendingGenerated holds the structs with Generated methods compiled for
+	// the type being added.
+	pendingGenerated []*structMarshaller
+}
+
+// update calls f with a copy of the registry while holding the lock. If f does
+// not panic the copy is published, otherwise the panic is returned as an error
+// and the registry is unchanged.
+func (t *Thresher) update(f func(c *compiler)) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := &compiler{
+		Thresher: t,
+		registry: t.load().clone(),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = toErr(r)
+			return
+		}
+		t.reg.Store(c.registry)
+	}()
+	f(c)
+	return
+}
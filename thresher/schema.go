@@ -0,0 +1,326 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Schema describes the wire format of a registered type. Structs holds every
+// struct reachable from Type; a TypeSchema with Kind Struct refers to one by
+// index. A Schema can be encoded with rye so that it can be published and
+// decoded by ParseSchema without the Go types.
+type Schema struct {
+	TypeID  uint64
+	Type    TypeSchema
+	Structs []StructSchema
+}
+
+// StructSchema describes the fields of a struct.
+type StructSchema struct {
+	Name     string
+	Fields   []FieldSchema
+	Reserved []uint64
+}
+
+// FieldSchema describes a single field of a struct.
+type FieldSchema struct {
+	ID   uint64
+	Name string
+	Type TypeSchema
+}
+
+// TypeSchema describes a type. Elem is set for Ptr and Slice and Struct is the
+// index into Schema.Structs for Struct. For an Interface, Interface is the name
+// of the interface and Implementations holds the TypeIDs of the registered
+// types that could fill it when the Schema was created. The value in an
+// interface is always prefixed with its TypeID. Custom is the name of a type
+// that encodes itself, such as a rye.Marshaler, or is encoded by a Codec; its
+// value is length prefixed bytes that only the type can decode and Kind is
+// informational. NilSlices is set on a []byte that is not a struct field when
+// the type is registered with NilSlices; it is prefixed by its byte length
+// like other slices so that a nil []byte is kept.
+type TypeSchema struct {
+	Kind            reflect.Kind
+	Elem            *TypeSchema
+	Struct          int
+	Interface       string
+	Implementations []uint64
+	Custom          string
+	NilSlices       bool
+}
+
+// Field returns the field with the given ID.
+func (ss StructSchema) Field(id uint64) (FieldSchema, bool) {
+	for _, f := range ss.Fields {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return FieldSchema{}, false
+}
+
+func (ss StructSchema) isReserved(id uint64) bool {
+	for _, r := range ss.Reserved {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Schema returns the Schema of a registered type.
+func (t *Thresher) Schema(typeID uint64) (Schema, error) {
+	return t.load().schema(t, typeID)
+}
+
+func (r *registry) schema(t *Thresher, typeID uint64) (Schema, error) {
+	m := r.marshaller(typeID)
+	if m == nil {
+		return Schema{}, ErrNotFound{typeID}
+	}
+	b := schemaBuilder{
+		t:       t,
+		r:       r,
+		structs: make(map[reflect.Type]int),
+	}
+	s := Schema{
+		TypeID: typeID,
+		Type:   b.typeSchema(m.t),
+	}
+	s.Structs = b.out
+	return s, nil
+}
+
+type schemaBuilder struct {
+	t       *Thresher
+	r       *registry
+	structs map[reflect.Type]int
+	out     []StructSchema
+}
+
+func (b *schemaBuilder) typeSchema(rt reflect.Type) TypeSchema {
+	if elem, ok := lazyElem(rt); ok {
+		// Lazy is encoded as the value it holds
+		return b.typeSchema(elem)
+	}
+	ts := TypeSchema{
+		Kind: rt.Kind(),
+	}
+	if b.r.codec(rt) != nil || b.t.custom(rt) != customNone {
+		ts.Custom = rt.String()
+		return ts
+	}
+	switch ts.Kind {
+	case reflect.Ptr, reflect.Slice:
+		elem := b.typeSchema(rt.Elem())
+		ts.Elem = &elem
+		ts.NilSlices = b.t.NilSlices && isBytes(ts)
+	case reflect.Struct:
+		ts.Struct = b.structSchema(rt)
+	case reflect.Interface:
+		ts.Interface = rt.String()
+		for _, id := range b.r.typeIDs() {
+			if b.r.marshaller(id).t.Implements(rt) {
+				ts.Implementations = append(ts.Implementations, id)
+			}
+		}
+	}
+	return ts
+}
+
+func (b *schemaBuilder) structSchema(rt reflect.Type) int {
+	if idx, found := b.structs[rt]; found {
+		return idx
+	}
+	idx := len(b.out)
+	b.structs[rt] = idx
+	b.out = append(b.out, StructSchema{
+		Name: rt.String(),
+	})
+	sm := b.r.structMarshallers[rt]
+	var fields []FieldSchema
+	for _, f := range sm.byOrder {
+		if f.fieldHeader == 0 {
+			continue
+		}
+		id, _ := splitHeader(f.fieldHeader)
+		ts := b.typeSchema(f.rt)
+		// a []byte field is not nested, see fieldOp
+		ts.NilSlices = false
+		fields = append(fields, FieldSchema{
+			ID:   id,
+			Name: f.name,
+			Type: ts,
+		})
+	}
+	b.out[idx].Fields = fields
+	b.out[idx].Reserved = sm.reserved
+	return idx
+}
+
+// Schemas returns the Schema of every registered type.
+func (t *Thresher) Schemas() []Schema {
+	var out []Schema
+	r := t.load()
+	for _, id := range r.typeIDs() {
+		s, _ := r.schema(t, id)
+		out = append(out, s)
+	}
+	return out
+}
+
+// Issue is a single problem found by CheckCompatible.
+type Issue struct {
+	Struct string
+	ID     uint64
+	Reason string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s RyeField %d: %s", i.Struct, i.ID, i.Reason)
+}
+
+// Report is returned by CheckCompatible.
+type Report struct {
+	Issues []Issue
+}
+
+// Safe returns true if no issues were found.
+func (r Report) Safe() bool {
+	return len(r.Issues) == 0
+}
+
+// CheckCompatible reports whether data written with the older Schema can be
+// read with the newer Schema and whether the change is safe going forward.
+// Fields are matched by ID so renaming a field is always safe. Removing a field
+// is only safe if its ID is reserved so that it cannot be reused with a
+// different type. Changing the type of a field is safe if it is the same or is
+// one of the widening conversions done by Unmarshal; between int sizes, between
+// uint sizes, float32 to float64 and between string and []byte.
+func CheckCompatible(older, newer Schema) Report {
+	c := compatChecker{
+		older:   older,
+		newer:   newer,
+		visited: make(map[[2]int]bool),
+	}
+	if older.TypeID != newer.TypeID {
+		c.issue("", 0, fmt.Sprintf("TypeID changed from %d to %d", older.TypeID, newer.TypeID))
+	}
+	if reason := c.checkType(older.Type, newer.Type); reason != "" {
+		c.issue("", 0, reason)
+	}
+	return c.report
+}
+
+type compatChecker struct {
+	older, newer Schema
+	visited      map[[2]int]bool
+	report       Report
+}
+
+func (c *compatChecker) issue(strct string, id uint64, reason string) {
+	c.report.Issues = append(c.report.Issues, Issue{
+		Struct: strct,
+		ID:     id,
+		Reason: reason,
+	})
+}
+
+// checkType returns a reason if a value written as older cannot be read as newer.
+// Structs are checked field by field and add their own issues.
+func (c *compatChecker) checkType(older, newer TypeSchema) string {
+	if older.Custom != "" || newer.Custom != "" {
+		if older.Custom != newer.Custom {
+			return fmt.Sprintf("%s cannot be decoded as %s", older.describe(), newer.describe())
+		}
+		return ""
+	}
+	if isBytes(older) && isBytes(newer) {
+		if older.NilSlices != newer.NilSlices {
+			return "nil and empty []byte are encoded differently"
+		}
+		return ""
+	}
+	if older.Kind != newer.Kind {
+		if widens(older.Kind, newer.Kind) {
+			return ""
+		}
+		return fmt.Sprintf("%s cannot be decoded as %s", older.Kind, newer.Kind)
+	}
+	switch older.Kind {
+	case reflect.Ptr, reflect.Slice:
+		return c.checkType(*older.Elem, *newer.Elem)
+	case reflect.Struct:
+		c.checkStruct(older.Struct, newer.Struct)
+	}
+	return ""
+}
+
+func (c *compatChecker) checkStruct(oldIdx, newIdx int) {
+	key := [2]int{oldIdx, newIdx}
+	if c.visited[key] {
+		return
+	}
+	c.visited[key] = true
+	older, newer := c.older.Structs[oldIdx], c.newer.Structs[newIdx]
+	for _, of := range older.Fields {
+		nf, found := newer.Field(of.ID)
+		if !found {
+			if !newer.isReserved(of.ID) {
+				c.issue(newer.Name, of.ID, fmt.Sprintf("field %s removed but ID not reserved", of.Name))
+			}
+			continue
+		}
+		if reason := c.checkType(of.Type, nf.Type); reason != "" {
+			c.issue(newer.Name, of.ID, reason)
+		}
+	}
+	for _, nf := range newer.Fields {
+		if older.isReserved(nf.ID) {
+			c.issue(newer.Name, nf.ID, fmt.Sprintf("field %s uses an ID reserved in the old schema", nf.Name))
+		}
+	}
+}
+
+// describe names the type for an Issue.
+func (ts TypeSchema) describe() string {
+	if ts.Custom != "" {
+		return ts.Custom
+	}
+	return ts.Kind.String()
+}
+
+func isBytes(ts TypeSchema) bool {
+	return ts.Kind == reflect.String || (ts.Kind == reflect.Slice && ts.Elem.Kind == reflect.Uint8)
+}
+
+var (
+	signedRank = map[reflect.Kind]int{
+		reflect.Int8:  1,
+		reflect.Int16: 2,
+		reflect.Int32: 3,
+		reflect.Int64: 4,
+		reflect.Int:   4,
+	}
+	unsignedRank = map[reflect.Kind]int{
+		reflect.Uint8:  1,
+		reflect.Uint16: 2,
+		reflect.Uint32: 3,
+		reflect.Uint64: 4,
+		reflect.Uint:   4,
+	}
+)
+
+// widens returns true if Unmarshal can decode a value written as old into new
+// without loss.
+func widens(old, new reflect.Kind) bool {
+	if o, ok := signedRank[old]; ok {
+		n, ok := signedRank[new]
+		return ok && n >= o
+	}
+	if o, ok := unsignedRank[old]; ok {
+		n, ok := unsignedRank[new]
+		return ok && n >= o
+	}
+	return old == reflect.Float32 && new == reflect.Float64
+}
@@ -0,0 +1,190 @@
+package thresher
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adamcolton/rye"
+	"github.com/stretchr/testify/assert"
+)
+
+type RecordV1 struct {
+	Count  int8    `RyeField:"1"`
+	Flags  uint8   `RyeField:"2"`
+	Score  float32 `RyeField:"3"`
+	Note   string  `RyeField:"4"`
+	Level  *int8   `RyeField:"5"`
+	Legacy string  `RyeField:"6"`
+}
+
+func (*RecordV1) TypeID() uint64 { return 20 }
+
+type RecordV2 struct {
+	_      struct{} `RyeReserved:"6-7"`
+	Count  int64    `RyeField:"1"`
+	Flags  uint32   `RyeField:"2"`
+	Score  float64  `RyeField:"3"`
+	Note   []byte   `RyeField:"4"`
+	Level  *int64   `RyeField:"5"`
+	Amount int      `RyeField:"8"`
+}
+
+func (*RecordV2) TypeID() uint64 { return 20 }
+
+type RecordBroken struct {
+	Count string `RyeField:"1"`
+}
+
+func (*RecordBroken) TypeID() uint64 { return 20 }
+
+type RecordReused struct {
+	_     struct{} `RyeReserved:"6"`
+	Count int8     `RyeField:"1"`
+	Reuse string   `RyeField:"6"`
+}
+
+func (*RecordReused) TypeID() uint64 { return 21 }
+
+func TestWidening(t *testing.T) {
+	v1, v2, broken := &Thresher{}, &Thresher{}, &Thresher{}
+	assert.NoError(t, v1.Register((*RecordV1)(nil)))
+	assert.NoError(t, v2.Register((*RecordV2)(nil)))
+	assert.NoError(t, broken.Register((*RecordBroken)(nil)))
+
+	lvl := int8(-7)
+	b, err := v1.Marshal(&RecordV1{
+		Count:  -5,
+		Flags:  200,
+		Score:  1.5,
+		Note:   "note",
+		Level:  &lvl,
+		Legacy: "old",
+	}, nil)
+	assert.NoError(t, err)
+
+	i, _, err := v2.Unmarshal(b)
+	assert.NoError(t, err)
+	lvl64 := int64(-7)
+	assert.Equal(t, &RecordV2{
+		Count: -5,
+		Flags: 200,
+		Score: 1.5,
+		Note:  []byte("note"),
+		Level: &lvl64,
+	}, i)
+
+	_, _, err = broken.Unmarshal(b)
+	assert.Equal(t, ErrIncompatible{
+		Struct: "thresher.RecordBroken",
+		ID:     1,
+		Got:    "fixed8",
+		Want:   "bytes",
+	}, err)
+}
+
+func TestReserved(t *testing.T) {
+	th := &Thresher{}
+	err := th.Register((*RecordReused)(nil))
+	assert.Equal(t, ErrReserved{
+		Struct: "thresher.RecordReused",
+		Field:  "Reuse",
+		ID:     6,
+	}, err)
+}
+
+func TestCheckCompatible(t *testing.T) {
+	v1, v2, broken := &Thresher{}, &Thresher{}, &Thresher{}
+	assert.NoError(t, v1.Register((*RecordV1)(nil)))
+	assert.NoError(t, v2.Register((*RecordV2)(nil)))
+	assert.NoError(t, broken.Register((*RecordBroken)(nil)))
+	s1, err := v1.Schema(20)
+	assert.NoError(t, err)
+	s2, err := v2.Schema(20)
+	assert.NoError(t, err)
+	sb, err := broken.Schema(20)
+	assert.NoError(t, err)
+
+	r := CheckCompatible(s1, s2)
+	assert.True(t, r.Safe(), r.Issues)
+
+	r = CheckCompatible(s2, s1)
+	assert.False(t, r.Safe())
+	assert.Len(t, r.Issues, 6)
+
+	r = CheckCompatible(s1, sb)
+	assert.Equal(t, []Issue{
+		{Struct: "thresher.RecordBroken", ID: 1, Reason: "int8 cannot be decoded as string"},
+		{Struct: "thresher.RecordBroken", ID: 2, Reason: "field Flags removed but ID not reserved"},
+		{Struct: "thresher.RecordBroken", ID: 3, Reason: "field Score removed but ID not reserved"},
+		{Struct: "thresher.RecordBroken", ID: 4, Reason: "field Note removed but ID not reserved"},
+		{Struct: "thresher.RecordBroken", ID: 5, Reason: "field Level removed but ID not reserved"},
+		{Struct: "thresher.RecordBroken", ID: 6, Reason: "field Legacy removed but ID not reserved"},
+	}, r.Issues)
+}
+
+func TestSchemaExport(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*AllTypes)(nil), (*Foo)(nil), (*A)(nil), (*B)(nil)))
+
+	s, err := th.Schema(6)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), s.TypeID)
+	assert.Equal(t, reflect.Ptr, s.Type.Kind)
+	assert.Equal(t, reflect.Struct, s.Type.Elem.Kind)
+	assert.Len(t, s.Structs, 2)
+
+	a := s.Structs[s.Type.Elem.Struct]
+	assert.Equal(t, "thresher.A", a.Name)
+	f, found := a.Field(3)
+	assert.True(t, found)
+	assert.Equal(t, "C", f.Name)
+	assert.Equal(t, TypeSchema{
+		Kind:            reflect.Interface,
+		Interface:       "thresher.HasType",
+		Implementations: []uint64{3, 4, 6, 7},
+	}, f.Type)
+
+	f, _ = a.Field(2)
+	b := s.Structs[f.Type.Elem.Struct]
+	assert.Equal(t, "thresher.B", b.Name)
+	f, _ = b.Field(2)
+	assert.Equal(t, s.Type, f.Type)
+
+	for _, s := range th.Schemas() {
+		data, err := rye.Marshal(s)
+		assert.NoError(t, err)
+		s2, err := ParseSchema(data)
+		assert.NoError(t, err)
+		assert.Equal(t, s, s2)
+
+		_, err = ParseSchema(data[:len(data)-1])
+		assert.Error(t, err)
+
+		data[0] = schemaVersion + 1
+		_, err = ParseSchema(data)
+		assert.Error(t, err)
+	}
+
+	_, err = th.Schema(100)
+	assert.Error(t, err)
+}
+
+func TestParseSchemaDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		ts := TypeSchema{Kind: reflect.Int}
+		for i := 0; i < depth; i++ {
+			elem := ts
+			ts = TypeSchema{Kind: reflect.Ptr, Elem: &elem}
+		}
+		data, err := rye.Marshal(Schema{TypeID: 1, Type: ts})
+		assert.NoError(t, err)
+		return data
+	}
+
+	s, err := ParseSchema(nested(DefaultMaxDepth - 1))
+	assert.NoError(t, err)
+	assert.Equal(t, reflect.Ptr, s.Type.Kind)
+
+	_, err = ParseSchema(nested(DefaultMaxDepth))
+	assert.Equal(t, ErrLimit{"MaxDepth", DefaultMaxDepth + 1, DefaultMaxDepth}, err)
+}
@@ -0,0 +1,224 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/adamcolton/rye"
+)
+
+// schemaVersion is written before an encoded Schema so the format can change.
+const schemaVersion byte = 1
+
+// customFlag is set on the kind byte of a TypeSchema with Custom set and
+// nilSlicesFlag on one with NilSlices set.
+const (
+	customFlag    byte = 0x80
+	nilSlicesFlag byte = 0x40
+)
+
+// ParseSchema decodes a Schema encoded with rye.Marshal.
+func ParseSchema(data []byte) (Schema, error) {
+	var s Schema
+	err := s.Unmarshal(rye.NewDeserializer(data))
+	return s, err
+}
+
+// MarshalSize fulfills rye.Marshaler.
+func (s Schema) MarshalSize() int {
+	size := 1 + rye.CompactUint64Size(s.TypeID) + s.Type.size()
+	size += rye.CompactUint64Size(uint64(len(s.Structs)))
+	for _, ss := range s.Structs {
+		size += ss.size()
+	}
+	return size
+}
+
+// Marshal fulfills rye.Marshaler.
+func (s Schema) Marshal(srl *rye.Serializer) error {
+	srl.Byte(schemaVersion)
+	srl.CompactUint64(s.TypeID)
+	s.Type.marshal(srl)
+	srl.CompactUint64(uint64(len(s.Structs)))
+	for _, ss := range s.Structs {
+		ss.marshal(srl)
+	}
+	return nil
+}
+
+// Unmarshal fulfills rye.Unmarshaler.
+func (s *Schema) Unmarshal(d *rye.Deserializer) (err error) {
+	defer recoverUnmarshal(&err)
+	if v := d.Byte(); v != schemaVersion {
+		return fmt.Errorf("thresher: unknown schema version %d", v)
+	}
+	s.TypeID = d.CompactUint64()
+	s.Type.unmarshal(d, 0)
+	if ln := checkLen(d); ln > 0 {
+		s.Structs = make([]StructSchema, ln)
+		for i := range s.Structs {
+			s.Structs[i].unmarshal(d)
+		}
+	}
+	return s.validate()
+}
+
+// checkLen reads a length and checks that it is not longer than the remaining
+// data. Every encoded element uses at least one byte.
+func checkLen(d *rye.Deserializer) int {
+	ln := d.CompactUint64()
+	if ln > uint64(len(d.Data)-d.Idx) {
+		panic(ErrMalformed{"length exceeds data"})
+	}
+	return int(ln)
+}
+
+func (ss StructSchema) size() int {
+	size := rye.CompactStringSize(ss.Name)
+	size += rye.CompactUint64Size(uint64(len(ss.Fields)))
+	for _, f := range ss.Fields {
+		size += rye.CompactUint64Size(f.ID) + rye.CompactStringSize(f.Name) + f.Type.size()
+	}
+	size += rye.CompactUint64Size(uint64(len(ss.Reserved)))
+	for _, r := range ss.Reserved {
+		size += rye.CompactUint64Size(r)
+	}
+	return size
+}
+
+func (ss StructSchema) marshal(s *rye.Serializer) {
+	s.CompactString(ss.Name)
+	s.CompactUint64(uint64(len(ss.Fields)))
+	for _, f := range ss.Fields {
+		s.CompactUint64(f.ID)
+		s.CompactString(f.Name)
+		f.Type.marshal(s)
+	}
+	s.CompactUint64(uint64(len(ss.Reserved)))
+	for _, r := range ss.Reserved {
+		s.CompactUint64(r)
+	}
+}
+
+func (ss *StructSchema) unmarshal(d *rye.Deserializer) {
+	ss.Name = d.CompactString()
+	if ln := checkLen(d); ln > 0 {
+		ss.Fields = make([]FieldSchema, ln)
+		for i := range ss.Fields {
+			f := &ss.Fields[i]
+			f.ID = d.CompactUint64()
+			f.Name = d.CompactString()
+			f.Type.unmarshal(d, 0)
+		}
+	}
+	if ln := checkLen(d); ln > 0 {
+		ss.Reserved = make([]uint64, ln)
+		for i := range ss.Reserved {
+			ss.Reserved[i] = d.CompactUint64()
+		}
+	}
+}
+
+func (ts TypeSchema) size() int {
+	size := 1
+	if ts.Custom != "" {
+		return size + rye.CompactStringSize(ts.Custom)
+	}
+	switch ts.Kind {
+	case reflect.Ptr, reflect.Slice:
+		size += ts.Elem.size()
+	case reflect.Struct:
+		size += rye.CompactUint64Size(uint64(ts.Struct))
+	case reflect.Interface:
+		size += rye.CompactStringSize(ts.Interface)
+		size += rye.CompactUint64Size(uint64(len(ts.Implementations)))
+		for _, id := range ts.Implementations {
+			size += rye.CompactUint64Size(id)
+		}
+	}
+	return size
+}
+
+func (ts TypeSchema) marshal(s *rye.Serializer) {
+	if ts.Custom != "" {
+		s.Byte(byte(ts.Kind) | customFlag)
+		s.CompactString(ts.Custom)
+		return
+	}
+	k := byte(ts.Kind)
+	if ts.NilSlices {
+		k |= nilSlicesFlag
+	}
+	s.Byte(k)
+	switch ts.Kind {
+	case reflect.Ptr, reflect.Slice:
+		ts.Elem.marshal(s)
+	case reflect.Struct:
+		s.CompactUint64(uint64(ts.Struct))
+	case reflect.Interface:
+		s.CompactString(ts.Interface)
+		s.CompactUint64(uint64(len(ts.Implementations)))
+		for _, id := range ts.Implementations {
+			s.CompactUint64(id)
+		}
+	}
+}
+
+// unmarshal decodes a TypeSchema. Pointers and slices cannot be nested more
+// than DefaultMaxDepth deep.
+func (ts *TypeSchema) unmarshal(d *rye.Deserializer, depth int) {
+	depth = checkDepth(depth+1, DefaultMaxDepth)
+	k := d.Byte()
+	ts.Kind = reflect.Kind(k &^ (customFlag | nilSlicesFlag))
+	if k&customFlag != 0 {
+		ts.Custom = d.CompactString()
+		return
+	}
+	ts.NilSlices = k&nilSlicesFlag != 0
+	switch ts.Kind {
+	case reflect.Ptr, reflect.Slice:
+		ts.Elem = &TypeSchema{}
+		ts.Elem.unmarshal(d, depth)
+	case reflect.Struct:
+		ts.Struct = int(d.CompactUint64())
+	case reflect.Interface:
+		ts.Interface = d.CompactString()
+		if ln := checkLen(d); ln > 0 {
+			ts.Implementations = make([]uint64, ln)
+			for i := range ts.Implementations {
+				ts.Implementations[i] = d.CompactUint64()
+			}
+		}
+	}
+}
+
+// validate checks that every struct index refers to a struct in the Schema.
+func (s Schema) validate() error {
+	if err := s.validateType(s.Type, 0); err != nil {
+		return err
+	}
+	for _, ss := range s.Structs {
+		for _, f := range ss.Fields {
+			if err := s.validateType(f.Type, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s Schema) validateType(ts TypeSchema, depth int) error {
+	depth = checkDepth(depth+1, DefaultMaxDepth)
+	if ts.Custom != "" {
+		return nil
+	}
+	switch ts.Kind {
+	case reflect.Ptr, reflect.Slice:
+		return s.validateType(*ts.Elem, depth)
+	case reflect.Struct:
+		if ts.Struct < 0 || ts.Struct >= len(s.Structs) {
+			return ErrMalformed{"struct index out of range"}
+		}
+	}
+	return nil
+}
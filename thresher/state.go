@@ -0,0 +1,165 @@
+package thresher
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/adamcolton/rye"
+)
+
+// encoder holds the state of a single call to Marshal. Marshal makes two
+// passes, the first computes the size and the second writes the data. The size
+// of each length delimited value is recorded during the first pass in the order
+// they are found and read back in the same order during the second pass so that
+// no value is sized more than once.
+type encoder struct {
+	*rye.Serializer
+	sizes   []int
+	sizeIdx int
+	// blobs holds values encoded during the first pass by types that can only
+	// produce their encoding as a byte slice.
+	blobs   [][]byte
+	blobIdx int
+	// refs is nil unless Thresher.TrackRefs is set.
+	refs map[refKey]uint64
+	reg  *registry
+	// maxSliceLen is Limits.MaxSliceLen so that a slice is not written that
+	// Unmarshal would reject.
+	maxSliceLen uint64
+}
+
+type refKey struct {
+	u unsafe.Pointer
+	t reflect.Type
+}
+
+func newEncoder(r *registry, trackRefs bool, l Limits) *encoder {
+	e := &encoder{
+		Serializer:  &rye.Serializer{},
+		reg:         r,
+		maxSliceLen: l.withDefaults().MaxSliceLen,
+	}
+	if trackRefs {
+		e.refs = make(map[refKey]uint64)
+	}
+	return e
+}
+
+// startSize reserves a place for the size of a length delimited value.
+func (e *encoder) startSize() int {
+	e.sizes = append(e.sizes, 0)
+	return len(e.sizes) - 1
+}
+
+// endSize records the size of a length delimited value and returns the size
+// including the length prefix.
+func (e *encoder) endSize(idx, size int) int {
+	e.sizes[idx] = size
+	return rye.CompactUint64Size(uint64(size)) + size
+}
+
+// nextSize returns the next size recorded during the first pass.
+func (e *encoder) nextSize() uint64 {
+	size := e.sizes[e.sizeIdx]
+	e.sizeIdx++
+	return uint64(size)
+}
+
+// addBlob records a value encoded during the first pass and returns its size
+// including the length prefix.
+func (e *encoder) addBlob(b []byte) int {
+	e.blobs = append(e.blobs, b)
+	return rye.CompactUint64Size(uint64(len(b))) + len(b)
+}
+
+// nextBlob returns the next value recorded during the first pass.
+func (e *encoder) nextBlob() []byte {
+	b := e.blobs[e.blobIdx]
+	e.blobIdx++
+	return b
+}
+
+// startWrite prepares the encoder for the second pass.
+func (e *encoder) startWrite(size int, in []byte) {
+	if cap(in) >= size {
+		e.Data = in[:size]
+	} else {
+		e.Data = make([]byte, size)
+	}
+	e.Size = size
+	e.sizeIdx = 0
+	e.blobIdx = 0
+	if e.refs != nil {
+		e.refs = make(map[refKey]uint64, len(e.refs))
+	}
+}
+
+// ref returns the ID of the pointer u and whether it has been seen before. If
+// not, it is assigned the next ID.
+func (e *encoder) ref(u unsafe.Pointer, t reflect.Type) (uint64, bool) {
+	k := refKey{u, t}
+	if id, found := e.refs[k]; found {
+		return id, true
+	}
+	id := uint64(len(e.refs)) + 1
+	e.refs[k] = id
+	return id, false
+}
+
+// decoder holds the state of a single call to Unmarshal.
+type decoder struct {
+	*rye.Deserializer
+	trackRefs bool
+	refs      []reflect.Value
+	limits    Limits
+	allocated uint64
+	depth     int
+	reg       *registry
+	// merge decodes into existing pointers instead of allocating, see Merge.
+	merge bool
+	// mergeInto is set when the next struct decoded holds an existing value
+	// being merged into, so its fields are not set to their defaults.
+	mergeInto bool
+	// checks is set if required fields and Validate methods are checked,
+	// see registry.checks.
+	checks bool
+}
+
+func newDecoder(data []byte, t *Thresher, r *registry) *decoder {
+	return &decoder{
+		Deserializer: rye.NewDeserializer(data),
+		reg:          r,
+		checks:       r.checks,
+		trackRefs:    t.TrackRefs,
+		limits:       t.Limits.withDefaults(),
+	}
+}
+
+// addRef records a newly decoded pointer. It must be called before the value
+// is decoded so that cycles can refer back to it.
+func (d *decoder) addRef(v reflect.Value) {
+	if d.trackRefs {
+		d.refs = append(d.refs, v)
+	}
+}
+
+// backRef sets the pointer at u to the pointer previously decoded with the
+// given ID.
+func (d *decoder) backRef(u unsafe.Pointer, id uint64, t reflect.Type) {
+	if id == 0 || id > uint64(len(d.refs)) || d.refs[id-1].Type().Elem() != t {
+		panic(ErrMalformed{"bad reference"})
+	}
+	*(*unsafe.Pointer)(u) = d.refs[id-1].UnsafePointer()
+}
+
+// refMap returns the decoded pointers by ID.
+func (d *decoder) refMap() map[uint64]interface{} {
+	if !d.trackRefs {
+		return nil
+	}
+	m := make(map[uint64]interface{}, len(d.refs))
+	for i, v := range d.refs {
+		m[uint64(i)+1] = v.Interface()
+	}
+	return m
+}
@@ -1,86 +1,237 @@
 package thresher
 
 import (
-	"errors"
+	"fmt"
 	"github.com/adamcolton/rye"
 	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
+// Thresher marshals and unmarshals registered types. A Thresher is safe for
+// concurrent use and types can be registered while other goroutines are
+// marshalling. Register and RegisterCodec build a new copy of the compiled
+// types while holding a lock and publish it with an atomic swap; Marshal,
+// Unmarshal and Schema never lock and see either all or none of the types
+// from a call to Register. The exported fields are configuration and must not
+// be changed once the Thresher is in use. A Thresher must not be copied after
+// first use.
 type Thresher struct {
-	typedIDMarshallers []*marshaller
-	structMarshallers  map[reflect.Type]*structMarshaller
+	// TrackRefs enables reference tracking. Each pointer is assigned an ID
+	// the first time it is marshalled and after that only the ID is written,
+	// so shared pointers and cycles are rebuilt by Unmarshal which returns the
+	// pointers by ID. It changes the encoding of pointers so it must be set
+	// before any types are registered and must match between the Thresher
+	// that marshals and the one that unmarshals. Fields that the reader does
+	// not have cannot be skipped, see ErrSkipRefs.
+	TrackRefs bool
+	// EncodingMarshalers enables encoding types that implement
+	// encoding.BinaryMarshaler or encoding.TextMarshaler with those methods.
+	// Types that implement rye.Marshaler and rye.Unmarshaler always encode
+	// themselves. It must be set before any types are registered.
+	EncodingMarshalers bool
+	// IgnoreGenerated encodes types with methods written by cmd/ryegen by
+	// reflection instead. The data is the same either way. It must be set
+	// before any types are registered.
+	IgnoreGenerated bool
+	// NilSlices keeps the difference between a nil slice and an empty one. By
+	// default both are omitted as fields and decoded as nil. With NilSlices an
+	// empty slice field is written and decoded as empty, and a nil slice
+	// inside another slice or behind a pointer is written with a length of 0
+	// and decoded as nil. A []byte that is not a struct field is prefixed by
+	// its byte length like other slices so that it is kept the same way; data
+	// with one can only be read with NilSlices, and its Schema has
+	// TypeSchema.NilSlices set. Other data written with NilSlices can be read
+	// by any Thresher. It must be set before any types are registered.
+	NilSlices bool
+	// WriteZero writes struct fields that are zero, so a field that was set
+	// to zero can be told apart from one that was not written. By default
+	// they are omitted. The RyeField options "always" and "omitzero" override
+	// it for a field, for example `RyeField:"3,always"`. Pointer and
+	// interface fields are only written if they are not nil, which makes a
+	// pointer such as *int the way to record that a scalar was set. It must
+	// be set before any types are registered.
+	WriteZero bool
+	// Limits bounds the resources used by Unmarshal. Marshal checks
+	// MaxSliceLen so that it does not write data that Unmarshal would reject.
+	Limits Limits
+
+	// mu serializes writers; readers only load reg.
+	mu  sync.Mutex
+	reg atomic.Pointer[registry]
 }
 
-func (t *Thresher) Unmarshal(data []byte) (interface{}, map[uint64]interface{}, error) {
-	d := rye.NewDeserializer(data)
-	vt := int(d.CompactUint64())
-	if vt > len(t.typedIDMarshallers) {
-		return nil, nil, errors.New("Not found")
-	}
-	m := t.typedIDMarshallers[vt]
-	if m == nil {
-		return nil, nil, errors.New("Not found")
+// toErr converts a recovered value into an error.
+func toErr(r interface{}) error {
+	if e, ok := r.(error); ok {
+		return e
 	}
-
-	r := reflect.New(m.t)
-	i := r.Elem().Interface()
-	base := uintptr(unsafe.Pointer(&i)) + ifcePtrOffset
-	m.op.unmarshal(uintptr(unsafe.Pointer(base)), d)
-	return i, nil, nil
+	return fmt.Errorf("thresher: %v", r)
 }
 
-func (t *Thresher) Marshal(v HasType, in []byte) ([]byte, error) {
-	vt := v.TypeID()
-	if len(t.typedIDMarshallers) < int(vt) {
-		return nil, errors.New("Not found")
+// recoverUnmarshal is deferred by Unmarshal. Reading past the end of truncated
+// data causes a runtime error which is returned as ErrMalformed.
+func recoverUnmarshal(err *error) {
+	if r := recover(); r != nil {
+		if re, ok := r.(runtime.Error); ok {
+			*err = ErrMalformed{re.Error()}
+		} else {
+			*err = toErr(r)
+		}
 	}
-	m := t.typedIDMarshallers[vt]
+}
+
+// Unmarshal data written by Marshal. The value returned has the type that was
+// registered, either T or *T. If TrackRefs is set, every pointer that was
+// decoded is also returned by its ID.
+func (t *Thresher) Unmarshal(data []byte) (i interface{}, refs map[uint64]interface{}, err error) {
+	defer recoverUnmarshal(&err)
+	reg := t.load()
+	d := newDecoder(data, t, reg)
+	vt := d.CompactUint64()
+	m := reg.marshaller(vt)
 	if m == nil {
-		return nil, errors.New("not found")
+		return nil, nil, ErrNotFound{vt}
 	}
 
-	base := uintptr(unsafe.Pointer(&v)) + ifcePtrOffset
-
-	s := &rye.Serializer{}
-	if in == nil {
-		s.Data = make([]byte, m.op.size(base)+rye.CompactUint64Size(vt))
-	} else {
-		s.Size = len(in)
-		s.Data = in
+	if d.checks {
+		defer recoverRoot(m.t)
 	}
-	s.CompactUint64(vt)
-	m.op.marshal(base, s)
-	return s.Data, nil
+	// decode into the heap; the stack can move during decoding
+	r := reflect.New(m.t)
+	m.op.unmarshal(r.UnsafePointer(), d)
+	return r.Elem().Interface(), d.refMap(), nil
 }
 
-func (t *Thresher) Register(vs ...HasType) (err error) {
+// Marshal v which must be a registered type, either by Register or
+// RegisterNamed. If v is a T and only *T is registered it is marshalled as a
+// pointer to v; if v is a *T and only T is registered the value it points to is
+// marshalled. If in has enough capacity it is used for the output instead of
+// allocating. An error returned by a type that encodes itself is returned by
+// Marshal.
+//
+// A value that is not a pointer is read from where the interface holds it
+// without being copied, so methods called by Marshal must not modify it.
+func (t *Thresher) Marshal(v interface{}, in []byte) (out []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = r.(error)
+			err = toErr(r)
 		}
 	}()
-	for _, v := range vs {
-		vid := v.TypeID()
-		if len(t.typedIDMarshallers) <= int(vid) {
-			ln := int(vid)
-			if ln < 256 {
-				ln = 256
-			}
-			s := make([]*marshaller, ln)
-			if t.typedIDMarshallers != nil {
-				copy(s, t.typedIDMarshallers)
-			}
-			t.typedIDMarshallers = s
+	reg := t.load()
+	rt := reflect.TypeOf(v)
+	if vt, found := reg.byType[rt]; found {
+		m := reg.marshaller(vt)
+		data := (*ifaceWords)(unsafe.Pointer(&v)).data
+		if !m.direct {
+			return t.marshal(reg, vt, m, data, in), nil
+		}
+		// the op needs the address of the pointer
+		cell := new(unsafe.Pointer)
+		*cell = data
+		return t.marshal(reg, vt, m, unsafe.Pointer(cell), in), nil
+	}
+	if rt == nil {
+		return nil, ErrNotRegistered{fmt.Sprint(rt)}
+	}
+	if rt.Kind() == reflect.Ptr {
+		vt, found := reg.byType[rt.Elem()]
+		if !found {
+			return nil, ErrNotRegistered{rt.String()}
 		}
-		if t.typedIDMarshallers[vid] != nil {
-			return errors.New("TypeID redefined")
+		rv := reflect.ValueOf(v)
+		if rv.IsNil() {
+			return nil, fmt.Errorf("thresher: cannot marshal a nil %s as %s", rt, rt.Elem())
+		}
+		return t.marshal(reg, vt, reg.marshaller(vt), rv.UnsafePointer(), in), nil
+	}
+	pt := reflect.PtrTo(rt)
+	vt, found := reg.byType[pt]
+	if !found {
+		return nil, ErrNotRegistered{rt.String()}
+	}
+	cell := reflect.New(pt)
+	cell.Elem().Set(reflect.New(rt))
+	cell.Elem().Elem().Set(reflect.ValueOf(v))
+	return t.marshal(reg, vt, reg.marshaller(vt), cell.UnsafePointer(), in), nil
+}
+
+// marshal writes the TypeID followed by the root value at base.
+func (t *Thresher) marshal(reg *registry, vt uint64, m *marshaller, base unsafe.Pointer, in []byte) []byte {
+	s := newEncoder(reg, t.TrackRefs, t.Limits)
+	s.startWrite(m.op.size(base, s)+rye.CompactUint64Size(vt), in)
+	s.CompactUint64(vt)
+	m.op.marshal(base, s)
+	return s.Data
+}
+
+// Register compiles the marshallers for each type. The type registered is the
+// type of each value, so a type with a TypeID method on a value receiver can be
+// registered as T or as *T, which may be a nil pointer. The whole type graph
+// reachable from each type is validated; if any part of it cannot be encoded
+// an error is returned and none of the types are registered.
+//
+// An embedded struct tagged `RyeField:",flatten"` is flattened: its tagged
+// fields are encoded as fields of the embedding struct and their IDs must not
+// collide with the embedding struct's own. Without a tag it is ignored like
+// any other untagged field.
+func (t *Thresher) Register(vs ...HasType) error {
+	return t.update(func(c *compiler) {
+		for _, v := range vs {
+			c.add(typeID(v), reflect.TypeOf(v))
 		}
-		vt := reflect.TypeOf(v)
-		t.typedIDMarshallers[vid] = &marshaller{
-			op: t.compile(vt),
-			t:  vt,
+	})
+}
+
+var hasTypeType = reflect.TypeOf((*HasType)(nil)).Elem()
+
+// typeID returns v.TypeID(). If v is a nil pointer and TypeID has a value
+// receiver it is called on the zero value instead, so a value type can be
+// registered as a pointer without allocating one.
+func typeID(v HasType) uint64 {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() && rv.Type().Elem().Implements(hasTypeType) {
+		return reflect.Zero(rv.Type().Elem()).Interface().(HasType).TypeID()
+	}
+	return v.TypeID()
+}
+
+// add compiles vt and registers it as vid.
+func (c *compiler) add(vid uint64, vt reflect.Type) {
+	if m := c.marshaller(vid); m != nil {
+		panic(ErrTypeIDRedefined{
+			TypeID:   vid,
+			Type:     vt.String(),
+			Existing: m.t.String(),
+		})
+	}
+	if id, found := c.byType[vt]; found {
+		panic(ErrTypeIDRedefined{
+			TypeID:   id,
+			Type:     vt.String(),
+			Existing: vt.String(),
+		})
+	}
+	m := &marshaller{
+		op:     c.compile(vt, rootPath(vt)),
+		t:      vt,
+		direct: direct(vt),
+	}
+	c.checkGenerated()
+	c.byType[vt] = vid
+	if vid >= maxDenseID {
+		c.sparse[vid] = m
+		return
+	}
+	if len(c.typedIDMarshallers) <= int(vid) {
+		ln := minDense
+		for ln <= int(vid) {
+			ln *= 2
 		}
+		s := make([]*marshaller, ln)
+		copy(s, c.typedIDMarshallers)
+		c.typedIDMarshallers = s
 	}
-	return
+	c.typedIDMarshallers[vid] = m
 }
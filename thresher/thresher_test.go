@@ -1,13 +1,16 @@
 package thresher
 
 import (
-	"fmt"
-	//	"github.com/adamcolton/rye"
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/adamcolton/rye"
 	"github.com/stretchr/testify/assert"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 )
@@ -207,10 +210,1337 @@ func TestCyclic(t *testing.T) {
 	assert.NotEqual(t, a, a2)
 }
 
+type BadInner struct {
+	Name     string `RyeField:"1"`
+	Callback func() `RyeField:"2"`
+}
+
+type BadOuter struct {
+	ID     int         `RyeField:"1"`
+	Inners []*BadInner `RyeField:"2"`
+}
+
+func (*BadOuter) TypeID() uint64 { return 8 }
+
+type Ignored struct {
+	Name  string         `RyeField:"1"`
+	Cache map[string]int `RyeField:"-"`
+	Ch    chan int
+}
+
+func (*Ignored) TypeID() uint64 { return 9 }
+
+type BadTag struct {
+	Name string `RyeField:"name"`
+}
+
+func (*BadTag) TypeID() uint64 { return 10 }
+
+func TestRegisterUnsupported(t *testing.T) {
+	th := &Thresher{}
+	err := th.Register((*Person)(nil), (*BadOuter)(nil))
+	assert.Equal(t, ErrUnsupported{
+		Struct: "thresher.BadInner",
+		Path:   "thresher.BadOuter.Inners[].Callback",
+		Kind:   reflect.Func,
+	}, err)
+	assert.Nil(t, th.reg.Load())
+
+	err = th.Register((*BadTag)(nil))
+	assert.Equal(t, ErrBadTag{
+		Struct: "thresher.BadTag",
+		Field:  "Name",
+		Tag:    "name",
+	}, err)
+
+	assert.NoError(t, th.Register((*Ignored)(nil)))
+	in := &Ignored{
+		Name:  "test",
+		Cache: map[string]int{"a": 1},
+		Ch:    make(chan int),
+	}
+	b, err := th.Marshal(in, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Ignored{Name: "test"}, i)
+}
+
+type PersonV1 struct {
+	Name    string `RyeField:"1"`
+	Age     int    `RyeField:"2"`
+	Unknown UnknownFields
+}
+
+func (*PersonV1) TypeID() uint64 { return 11 }
+
+type PersonV2 struct {
+	Name     string    `RyeField:"1"`
+	Age      int       `RyeField:"2"`
+	Nick     string    `RyeField:"3"`
+	Height   float32   `RyeField:"4"`
+	Weight   float64   `RyeField:"5"`
+	Flags    int8      `RyeField:"6"`
+	Address  *Bar      `RyeField:"7"`
+	Tags     []string  `RyeField:"8"`
+	Friends  []*Person `RyeField:"9"`
+	Favorite HasType   `RyeField:"10"`
+	Raw      []byte    `RyeField:"300"`
+}
+
+func (*PersonV2) TypeID() uint64 { return 11 }
+
+func TestUnknownFields(t *testing.T) {
+	newer := &Thresher{}
+	assert.NoError(t, newer.Register((*PersonV2)(nil), (*Person)(nil)))
+	older := &Thresher{}
+	assert.NoError(t, older.Register((*PersonV1)(nil)))
+
+	p2 := &PersonV2{
+		Name:    "Adam",
+		Age:     34,
+		Nick:    "AC",
+		Height:  1.8,
+		Weight:  75.5,
+		Flags:   -3,
+		Address: &Bar{"Pi Dr", 31415},
+		Tags:    []string{"a", "b"},
+		Friends: []*Person{
+			{First: "Bob"},
+			nil,
+		},
+		Favorite: &Person{Last: "Smith"},
+		Raw:      []byte{1, 2, 3},
+	}
+	b, err := newer.Marshal(p2, nil)
+	assert.NoError(t, err)
+
+	i, _, err := older.Unmarshal(b)
+	assert.NoError(t, err)
+	p1 := i.(*PersonV1)
+	assert.Equal(t, "Adam", p1.Name)
+	assert.Equal(t, 34, p1.Age)
+	assert.NotEmpty(t, p1.Unknown)
+
+	b, err = older.Marshal(p1, nil)
+	assert.NoError(t, err)
+	i, _, err = newer.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, p2, i)
+
+	_, _, err = older.Unmarshal(b[:len(b)-3])
+	assert.IsType(t, ErrMalformed{}, err)
+}
+
+type Shared struct {
+	X *Bar   `RyeField:"1"`
+	Y *Bar   `RyeField:"2"`
+	Z []*Bar `RyeField:"3"`
+}
+
+func (*Shared) TypeID() uint64 { return 12 }
+
+// SharedV1 is Shared without X.
+type SharedV1 struct {
+	Y *Bar   `RyeField:"2"`
+	Z []*Bar `RyeField:"3"`
+}
+
+func (*SharedV1) TypeID() uint64 { return 12 }
+
+func TestTrackRefs(t *testing.T) {
+	th := &Thresher{TrackRefs: true}
+	assert.NoError(t, th.Register((*A)(nil), (*B)(nil), (*Shared)(nil)))
+
+	a := &A{
+		A: 5,
+		B: &B{
+			B: 10,
+		},
+	}
+	a.B.A = a
+	a.C = a.B
+	a.B.C = a
+
+	b, err := th.Marshal(a, nil)
+	assert.NoError(t, err)
+	i, refs, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	a2 := i.(*A)
+	assert.Equal(t, 5, a2.A)
+	assert.Equal(t, 10, a2.B.B)
+	assert.True(t, a2.B.A == a2)
+	assert.True(t, a2.C.(*B) == a2.B)
+	assert.True(t, a2.B.C.(*A) == a2)
+	assert.Equal(t, map[uint64]interface{}{
+		1: a2,
+		2: a2.B,
+	}, refs)
+
+	bar := &Bar{"shared", 1}
+	sh := &Shared{
+		X: bar,
+		Y: bar,
+		Z: []*Bar{bar, {"other", 2}, bar, nil},
+	}
+	b, err = th.Marshal(sh, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	sh2 := i.(*Shared)
+	assert.Equal(t, sh, sh2)
+	assert.True(t, sh2.X == sh2.Y)
+	assert.True(t, sh2.X == sh2.Z[0])
+	assert.True(t, sh2.X == sh2.Z[2])
+	assert.False(t, sh2.X == sh2.Z[1])
+
+	// a field holding pointers cannot be skipped
+	older := &Thresher{TrackRefs: true}
+	assert.NoError(t, older.Register((*SharedV1)(nil)))
+	_, _, err = older.Unmarshal(b)
+	assert.Equal(t, ErrSkipRefs{Struct: "thresher.SharedV1", ID: 1}, err)
+	b, err = th.Marshal(&Shared{Y: bar, Z: []*Bar{bar}}, nil)
+	assert.NoError(t, err)
+	i, _, err = older.Unmarshal(b)
+	assert.NoError(t, err)
+	v1 := i.(*SharedV1)
+	assert.True(t, v1.Y == v1.Z[0])
+
+	// without TrackRefs shared pointers are copied
+	th = &Thresher{}
+	assert.NoError(t, th.Register((*Shared)(nil)))
+	b, err = th.Marshal(sh, nil)
+	assert.NoError(t, err)
+	i, refs, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Nil(t, refs)
+	sh2 = i.(*Shared)
+	assert.Equal(t, sh, sh2)
+	assert.False(t, sh2.X == sh2.Y)
+}
+
+type Nested struct {
+	Next *Nested `RyeField:"1"`
+}
+
+func (*Nested) TypeID() uint64 { return 13 }
+
+func TestLimits(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Foo)(nil), (*BarSlice)(nil), (*Nested)(nil)))
+
+	// TypeID, presence, byte length, a slice length of 1<<60 and no data
+	data := []byte{128 | 3, 1, 128 | 10, 0, 0, 0, 0, 0, 0, 0, 0, 16}
+	_, _, err := th.Unmarshal(data)
+	assert.Equal(t, ErrLimit{"MaxSliceLen", 1 << 60, DefaultSliceThreshold}, err)
+
+	// a slice length within the limit but longer than the data
+	data = []byte{128 | 3, 1, 128 | 2, 128 | 100}
+	_, _, err = th.Unmarshal(data)
+	assert.IsType(t, ErrMalformed{}, err)
+
+	f := Foo{"this", "is", "a", "test"}
+	b, err := th.Marshal(&f, nil)
+	assert.NoError(t, err)
+
+	th.Limits = Limits{MaxSliceLen: 3}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrLimit{"MaxSliceLen", 4, 3}, err)
+
+	th.Limits = Limits{MaxStringLen: 3}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrLimit{"MaxStringLen", 4, 3}, err)
+
+	// the Foo and its string headers are allocated before the strings
+	alloc := uint64(unsafe.Sizeof(f) + 4*unsafe.Sizeof(""))
+	th.Limits = Limits{MaxAlloc: alloc - 1}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrLimit{"MaxAlloc", alloc, alloc - 1}, err)
+
+	n := &Nested{}
+	for i := 0; i < 10; i++ {
+		n = &Nested{Next: n}
+	}
+	b, err = th.Marshal(n, nil)
+	assert.NoError(t, err)
+	th.Limits = Limits{MaxDepth: 5}
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrLimit{"MaxDepth", 6, 5}, err)
+
+	th.Limits = Limits{}
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, n, i)
+
+	// an unknown field nested deeper than the limit is not skipped
+	depth := DefaultMaxDepth + 10
+	data = []byte{128 | 13, 1}
+	for i := 0; i < depth; i++ {
+		data = append(data, 128|byte(makeHeader(5, wireGroup)))
+	}
+	for i := 0; i <= depth; i++ {
+		data = append(data, 128)
+	}
+	limit := ErrLimit{"MaxDepth", DefaultMaxDepth + 1, DefaultMaxDepth}
+	_, _, err = th.Unmarshal(data)
+	assert.Equal(t, limit, err)
+	_, err = DecodeWire(data)
+	assert.Equal(t, limit, err)
+	_, err = DecodeDynamic(data, th.Schemas()...)
+	assert.Equal(t, limit, err)
+	_, err = th.Patch(data, 13, 1, &Nested{})
+	assert.Equal(t, limit, err)
+}
+
+type Meta struct {
+	Created int64  `RyeField:"1"`
+	Owner   string `RyeField:"2"`
+	cache   string
+}
+
+type Audit struct {
+	Meta     `RyeField:",flatten"`
+	Revision int `RyeField:"3"`
+}
+
+type Document struct {
+	Audit `RyeField:",flatten"`
+	Title string `RyeField:"4"`
+	Inner Meta   `RyeField:"5"`
+}
+
+func TestMarshalSliceLimit(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Foo)(nil)))
+
+	f := make(Foo, DefaultSliceThreshold)
+	b, err := th.Marshal(&f, nil)
+	assert.NoError(t, err)
+	got, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &f, got)
+
+	f = append(f, "")
+	_, err = th.Marshal(&f, nil)
+	assert.Equal(t, ErrLimit{"MaxSliceLen", DefaultSliceThreshold + 1, DefaultSliceThreshold}, err)
+
+	th.Limits = Limits{MaxSliceLen: DefaultSliceThreshold + 1}
+	b, err = th.Marshal(&f, nil)
+	assert.NoError(t, err)
+	got, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &f, got)
+}
+
+func (*Document) TypeID() uint64 { return 14 }
+
+type Clash struct {
+	Meta `RyeField:",flatten"`
+	Name string `RyeField:"2"`
+}
+
+func (*Clash) TypeID() uint64 { return 15 }
+
+type EmbeddedPtr struct {
+	*Meta `RyeField:",flatten"`
+}
+
+func (*EmbeddedPtr) TypeID() uint64 { return 16 }
+
+func TestEmbedded(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Document)(nil)))
+
+	d := &Document{
+		Audit: Audit{
+			Meta:     Meta{Created: 1234, Owner: "adam", cache: "dropped"},
+			Revision: 3,
+		},
+		Title: "embedding",
+		Inner: Meta{Created: 5678},
+	}
+	b, err := th.Marshal(d, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	d.cache = ""
+	assert.Equal(t, d, i)
+
+	s, err := th.Schema(14)
+	assert.NoError(t, err)
+	fields := s.Structs[s.Type.Struct].Fields
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	assert.Equal(t, []string{"Created", "Owner", "Revision", "Title", "Inner"}, names)
+
+	err = th.Register((*Clash)(nil))
+	assert.Equal(t, ErrFieldRedefined{
+		Struct:   "thresher.Clash",
+		ID:       2,
+		Field:    "Name",
+		Previous: "Owner",
+	}, err)
+
+	err = th.Register((*EmbeddedPtr)(nil))
+	assert.Equal(t, ErrUnsupported{
+		Struct: "thresher.EmbeddedPtr",
+		Path:   "thresher.EmbeddedPtr.Meta",
+		Kind:   reflect.Ptr,
+	}, err)
+
+	// without the flatten option an untagged embedded struct is ignored
+	type Ignored struct {
+		Meta
+		Title string `RyeField:"1"`
+	}
+	assert.NoError(t, th.RegisterNamed("ignored embedding", (*Ignored)(nil)))
+	b, err = th.Marshal(&Ignored{Meta: Meta{Created: 1}, Title: "x"}, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Ignored{Title: "x"}, i)
+
+	type NotEmbedded struct {
+		M Meta `RyeField:",flatten"`
+	}
+	err = th.RegisterNamed("flatten field", (*NotEmbedded)(nil))
+	assert.Equal(t, ErrBadTag{
+		Struct: "thresher.NotEmbedded",
+		Field:  "M",
+		Tag:    ",flatten",
+	}, err)
+}
+
+// TestConcurrent registers types while other goroutines marshal through the
+// same Thresher. It is most useful with -race.
+func TestConcurrent(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Person)(nil)))
+	p := &Person{First: "Adam", Last: "Colton", Age: 34}
+	f := &Foo{"this", "is", "a", "test"}
+	n := &Nested{Next: &Nested{}}
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	register := [][]HasType{
+		{(*Foo)(nil), (*AllTypes)(nil)},
+		{(*BarSlice)(nil)},
+		{(*Nested)(nil)},
+		{(*Document)(nil)},
+		{(*BadOuter)(nil)},
+		{(*Shape)(nil)},
+	}
+	for _, vs := range register {
+		writers.Add(1)
+		go func(vs []HasType) {
+			defer writers.Done()
+			th.Register(vs...)
+		}(vs)
+	}
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		assert.NoError(t, th.RegisterCodec(reflect.TypeOf(UUID{}), uuidCodec{}))
+	}()
+
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, v := range []HasType{p, f, n} {
+					b, err := th.Marshal(v, nil)
+					if err != nil {
+						// not registered yet
+						continue
+					}
+					out, _, err := th.Unmarshal(b)
+					assert.NoError(t, err)
+					assert.Equal(t, v, out)
+				}
+				th.Schemas()
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	assert.NoError(t, th.Register((*Event)(nil)))
+	_, err := th.Schema(8)
+	assert.Equal(t, ErrNotFound{8}, err)
+	for _, id := range []uint64{2, 3, 4, 5, 13, 14, 30, 32} {
+		_, err := th.Schema(id)
+		assert.NoError(t, err)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Person)(nil), (*Foo)(nil)))
+
+	p := &Person{First: "Adam", Last: "Colton", Age: 34}
+	b, err := MarshalAs(th, p)
+	assert.NoError(t, err)
+	expected, err := th.Marshal(p, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, b)
+
+	p2 := Person{City: "Williamston"}
+	assert.NoError(t, UnmarshalInto(th, b, &p2))
+	assert.Equal(t, *p, p2)
+
+	f := Foo{"a", "b"}
+	b, err = MarshalAs(th, &f)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrTypeMismatch{Want: 2, Got: 3}, UnmarshalInto(th, b, &p2))
+	var f2 Foo
+	assert.NoError(t, UnmarshalInto(th, b, &f2))
+	assert.Equal(t, f, f2)
+
+	_, err = MarshalAs(th, &Bar{})
+	assert.Equal(t, ErrNotRegistered{"*thresher.Bar"}, err)
+
+	// a cycle back to the root refers to the value provided
+	th = &Thresher{TrackRefs: true}
+	assert.NoError(t, th.Register((*A)(nil), (*B)(nil)))
+	a := &A{A: 5, B: &B{B: 10}}
+	a.B.A = a
+	b, err = MarshalAs(th, a)
+	assert.NoError(t, err)
+	var a2 A
+	assert.NoError(t, UnmarshalInto(th, b, &a2))
+	assert.Equal(t, 10, a2.B.B)
+	assert.True(t, a2.B.A == &a2)
+}
+
+func TestUnmarshalIntoModes(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*PersonV2)(nil), (*Person)(nil)))
+
+	update := &PersonV2{
+		Age:     35,
+		Address: &Bar{Foo: "b"},
+		Tags:    []string{"y", "z"},
+	}
+	b, err := th.Marshal(update, nil)
+	assert.NoError(t, err)
+
+	addr := &Bar{"a", 1}
+	p := &PersonV2{
+		Name:    "Adam",
+		Age:     34,
+		Nick:    "ac",
+		Address: addr,
+		Tags:    []string{"x"},
+	}
+	assert.NoError(t, th.UnmarshalInto(b, p, Merge))
+	assert.Equal(t, &PersonV2{
+		Name:    "Adam",
+		Age:     35,
+		Nick:    "ac",
+		Address: &Bar{"b", 1},
+		Tags:    []string{"y", "z"},
+	}, p)
+	assert.True(t, addr == p.Address)
+
+	assert.NoError(t, th.UnmarshalInto(b, p, Overwrite))
+	assert.Equal(t, update, p)
+	assert.False(t, addr == p.Address)
+
+	assert.Equal(t, ErrTypeMismatch{Want: 2, Got: 11}, th.UnmarshalInto(b, &Person{}, Merge))
+	assert.Error(t, th.UnmarshalInto(b, (*PersonV2)(nil), Merge))
+}
+
+type Envelope struct {
+	Body interface{} `RyeField:"1"`
+}
+
+func (*Envelope) TypeID() uint64 { return 17 }
+
+func TestRegisterNamed(t *testing.T) {
+	// the ID must never change for a name
+	assert.Equal(t, uint64(1<<32|0x04cae2c8), NamedID("pkg.Person"))
+
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Envelope)(nil), (*Person)(nil)))
+	// Bar does not implement HasType
+	assert.NoError(t, th.RegisterNamed("thresher.Bar", (*Bar)(nil)))
+
+	bar := &Bar{"a", 1}
+	b, err := th.Marshal(bar, nil)
+	assert.NoError(t, err)
+	// a 5 byte TypeID, presence byte, 2 fields and the end
+	assert.Len(t, b, 12)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, bar, i)
+
+	e := &Envelope{Body: bar}
+	b, err = th.Marshal(e, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, e, i)
+
+	_, err = th.Marshal(&Envelope{Body: &Foo{}}, nil)
+	assert.Equal(t, ErrNotRegistered{"*thresher.Foo"}, err)
+
+	err = th.RegisterNamed("thresher.Bar", (*Bar)(nil))
+	assert.Equal(t, ErrTypeIDRedefined{
+		TypeID:   NamedID("thresher.Bar"),
+		Type:     "*thresher.Bar",
+		Existing: "*thresher.Bar",
+	}, err)
+	err = th.RegisterNamed("thresher.Person", (*Person)(nil))
+	assert.Equal(t, ErrTypeIDRedefined{
+		TypeID:   2,
+		Type:     "*thresher.Person",
+		Existing: "*thresher.Person",
+	}, err)
+
+	var ids []uint64
+	for _, s := range th.Schemas() {
+		ids = append(ids, s.TypeID)
+	}
+	assert.Equal(t, []uint64{2, 17, NamedID("thresher.Bar")}, ids)
+}
+
+type ID256 struct {
+	N int `RyeField:"1"`
+}
+
+func (*ID256) TypeID() uint64 { return 256 }
+
+type ID4096 struct {
+	N int `RyeField:"1"`
+}
+
+func (*ID4096) TypeID() uint64 { return 4096 }
+
+type IDHuge struct {
+	N int `RyeField:"1"`
+}
+
+func (*IDHuge) TypeID() uint64 { return 1<<63 + 1 }
+
+func TestTypeIDTable(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Person)(nil), (*ID256)(nil), (*ID4096)(nil), (*IDHuge)(nil)))
+	reg := th.load()
+	assert.Len(t, reg.typedIDMarshallers, 512)
+	assert.Len(t, reg.sparse, 2)
+
+	for _, v := range []HasType{&ID256{1}, &ID4096{2}, &IDHuge{3}} {
+		b, err := th.Marshal(v, nil)
+		assert.NoError(t, err)
+		i, _, err := th.Unmarshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, v, i)
+	}
+
+	for _, id := range []uint64{300, 512, 4097, 1 << 40} {
+		s := &rye.Serializer{Size: rye.CompactUint64Size(id)}
+		s.Make()
+		s.CompactUint64(id)
+		_, _, err := th.Unmarshal(s.Data)
+		assert.Equal(t, ErrNotFound{id}, err)
+	}
+}
+
+type ValueID uint64
+
+func (ValueID) TypeID() uint64 { return 18 }
+
+type Pair struct {
+	A int `RyeField:"1"`
+	B int `RyeField:"2"`
+}
+
+func (Pair) TypeID() uint64 { return 19 }
+
+type Holder struct {
+	V interface{} `RyeField:"1"`
+}
+
+func (*Holder) TypeID() uint64 { return 22 }
+
+func TestValueRoots(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register(ValueID(0), Pair{}, (*Holder)(nil)))
+
+	vid := ValueID(300)
+	b, err := th.Marshal(vid, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, vid, i)
+
+	// a pointer to a registered value type marshals the value
+	pb, err := th.Marshal(&vid, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, b, pb)
+	_, err = th.Marshal((*ValueID)(nil), nil)
+	assert.EqualError(t, err, "thresher: cannot marshal a nil *thresher.ValueID as thresher.ValueID")
+	_, err = MarshalAs[ValueID](th, nil)
+	assert.EqualError(t, err, "thresher: cannot marshal a nil *thresher.ValueID as thresher.ValueID")
+
+	p := Pair{1, 2}
+	b, err = th.Marshal(p, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, p, i)
+
+	for _, v := range []interface{}{vid, p} {
+		h := &Holder{V: v}
+		b, err := th.Marshal(h, nil)
+		assert.NoError(t, err)
+		i, _, err := th.Unmarshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, h, i)
+	}
+
+	// TypeID has a value receiver so it is called on the zero value rather
+	// than the nil pointer
+	pth := &Thresher{}
+	assert.NoError(t, pth.Register((*ValueID)(nil), (*Pair)(nil)))
+	b, err = pth.Marshal(p, nil)
+	assert.NoError(t, err)
+	i, _, err = pth.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &p, i)
+
+	// a value root is read where the interface holds it; a pointer root needs
+	// a cell holding the pointer
+	buf := make([]byte, 0, 64)
+	var value, ptr interface{} = p, &p
+	valueAllocs := testing.AllocsPerRun(100, func() { th.Marshal(value, buf) })
+	ptrAllocs := testing.AllocsPerRun(100, func() { pth.Marshal(ptr, buf) })
+	assert.Less(t, valueAllocs, ptrAllocs)
+}
+
+type Slices struct {
+	Ints   []int     `RyeField:"1"`
+	Nested [][]int   `RyeField:"2"`
+	Ptr    *[]string `RyeField:"3"`
+	Bytes  []byte    `RyeField:"4"`
+}
+
+func (*Slices) TypeID() uint64 { return 23 }
+
+type Settings struct {
+	Count int      `RyeField:"1,always"`
+	Name  string   `RyeField:"2"`
+	Ratio float64  `RyeField:"3,omitzero"`
+	Limit *int     `RyeField:"4,always"`
+	Tags  []string `RyeField:"5"`
+}
+
+func (*Settings) TypeID() uint64 { return 24 }
+
+func TestWriteZero(t *testing.T) {
+	limit := 7
+	current := func() *Settings {
+		return &Settings{
+			Count: 5,
+			Name:  "x",
+			Ratio: 2,
+			Limit: &limit,
+			Tags:  []string{"a"},
+		}
+	}
+
+	// a zero field is only written if it has the always option; a nil
+	// pointer is never written
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Settings)(nil)))
+	b, err := th.Marshal(&Settings{}, nil)
+	assert.NoError(t, err)
+	s := current()
+	assert.NoError(t, th.UnmarshalInto(b, s, Merge))
+	assert.Equal(t, &Settings{
+		Name:  "x",
+		Ratio: 2,
+		Limit: &limit,
+		Tags:  []string{"a"},
+	}, s)
+
+	wth := &Thresher{WriteZero: true}
+	assert.NoError(t, wth.Register((*Settings)(nil)))
+	b, err = wth.Marshal(&Settings{}, nil)
+	assert.NoError(t, err)
+	s = current()
+	assert.NoError(t, wth.UnmarshalInto(b, s, Merge))
+	assert.Equal(t, &Settings{
+		Ratio: 2,
+		Limit: &limit,
+	}, s)
+
+	// a pointer to zero records that the value was set
+	b, err = th.Marshal(&Settings{Limit: new(int)}, nil)
+	assert.NoError(t, err)
+	s = current()
+	assert.NoError(t, th.UnmarshalInto(b, s, Merge))
+	assert.Equal(t, 0, *s.Limit)
+
+	type BadOption struct {
+		A int `RyeField:"1,sometimes"`
+	}
+	type BothOptions struct {
+		A int `RyeField:"1,always,omitzero"`
+	}
+	for _, v := range []interface{}{(*BadOption)(nil), (*BothOptions)(nil)} {
+		assert.IsType(t, ErrBadTag{}, th.RegisterNamed("bad", v))
+	}
+}
+
+type Defaults struct {
+	Port  int           `RyeField:"1,default=8080"`
+	Host  string        `RyeField:"2" RyeDefault:"localhost, by default"`
+	Ratio float32       `RyeField:"3,default=0.5"`
+	Level uint8         `RyeField:"4,always,default=3"`
+	Items []DefaultItem `RyeField:"5"`
+}
+
+func (*Defaults) TypeID() uint64 { return 26 }
+
+type DefaultItem struct {
+	N    int    `RyeField:"1,default=1"`
+	Name string `RyeField:"2"`
+}
+
+func TestDefaults(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Defaults)(nil)))
+
+	dflt := &Defaults{
+		Port:  8080,
+		Host:  "localhost, by default",
+		Ratio: 0.5,
+		Level: 3,
+	}
+	b, err := th.Marshal(dflt, nil)
+	assert.NoError(t, err)
+	w, err := DecodeWire(b)
+	assert.NoError(t, err)
+	// only the field with the always option is written
+	assert.Len(t, w.(DynamicInterface).Value.(DynamicStruct).Fields, 1)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, dflt, i)
+
+	// a zero field is written when it has a default
+	zero := &Defaults{
+		Items: []DefaultItem{{Name: "a"}, {N: 1}},
+	}
+	b, err = th.Marshal(zero, nil)
+	assert.NoError(t, err)
+	i, _, err = th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, zero, i)
+
+	// merged fields that are not in the data are kept, new structs get their
+	// defaults
+	b, err = th.Marshal(&Defaults{
+		Port:  8080,
+		Items: []DefaultItem{{N: 1, Name: "b"}},
+	}, nil)
+	assert.NoError(t, err)
+	d := &Defaults{Port: 1, Host: "h"}
+	assert.NoError(t, th.UnmarshalInto(b, d, Merge))
+	assert.Equal(t, &Defaults{
+		Port:  1,
+		Host:  "",
+		Items: []DefaultItem{{N: 1, Name: "b"}},
+	}, d)
+
+	type BadDefault struct {
+		A int `RyeField:"1,default=x"`
+	}
+	type SliceDefault struct {
+		A []int `RyeField:"1,default=1"`
+	}
+	type TwoDefaults struct {
+		A int `RyeField:"1,default=1" RyeDefault:"2"`
+	}
+	for _, v := range []interface{}{(*BadDefault)(nil), (*SliceDefault)(nil), (*TwoDefaults)(nil)} {
+		assert.IsType(t, ErrBadTag{}, th.RegisterNamed("bad", v))
+	}
+}
+
+type Order struct {
+	ID    string      `RyeField:"1,required"`
+	Items []OrderItem `RyeField:"2"`
+	Note  *string     `RyeField:"3,required"`
+}
+
+func (*Order) TypeID() uint64 { return 27 }
+
+type OrderItem struct {
+	SKU string `RyeField:"1,required"`
+	Qty int    `RyeField:"2,required"`
+}
+
+var errNegative = errors.New("negative quantity")
+
+func (i *OrderItem) Validate() error {
+	if i.Qty < 0 {
+		return errNegative
+	}
+	return nil
+}
+
+// OrderV1 has the same fields as Order without the required options.
+type OrderV1 struct {
+	ID    string        `RyeField:"1"`
+	Items []OrderItemV1 `RyeField:"2"`
+}
+
+func (*OrderV1) TypeID() uint64 { return 27 }
+
+type OrderItemV1 struct {
+	SKU string `RyeField:"1"`
+	Qty int    `RyeField:"2"`
+}
+
+func TestRequired(t *testing.T) {
+	v1 := &Thresher{}
+	assert.NoError(t, v1.Register((*OrderV1)(nil)))
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Order)(nil)))
+
+	// required fields are written even if they are zero
+	note := ""
+	o := &Order{
+		Items: []OrderItem{{}},
+		Note:  &note,
+	}
+	b, err := th.Marshal(o, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, o, i)
+
+	b, err = v1.Marshal(&OrderV1{
+		ID:    "a",
+		Items: []OrderItemV1{{SKU: "x", Qty: 1}, {Qty: 2}},
+	}, nil)
+	assert.NoError(t, err)
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrRequired{[]string{"Order.Items[1].SKU"}}, err)
+
+	b, err = v1.Marshal(&OrderV1{
+		Items: []OrderItemV1{{SKU: "x", Qty: 1}},
+	}, nil)
+	assert.NoError(t, err)
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrRequired{[]string{"Order.ID", "Order.Note"}}, err)
+	assert.EqualError(t, err, "thresher: missing required Order.ID, Order.Note")
+
+	// fields that are not in the data are kept when merging
+	merged := &Order{ID: "b", Note: &note}
+	assert.NoError(t, th.UnmarshalInto(b, merged, Merge))
+	assert.Equal(t, "b", merged.ID)
+	assert.Equal(t, ErrRequired{[]string{"Order.ID", "Order.Note"}}, th.UnmarshalInto(b, &Order{}, Overwrite))
+
+	b, err = v1.Marshal(&OrderV1{
+		ID:    "a",
+		Items: []OrderItemV1{{SKU: "x", Qty: 1}, {SKU: "y", Qty: -1}},
+	}, nil)
+	assert.NoError(t, err)
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrInvalid{Path: "Order.Items[1]", Err: errNegative}, err)
+	assert.True(t, errors.Is(err, errNegative))
+	assert.EqualError(t, err, "thresher: invalid Order.Items[1]: negative quantity")
+	assert.Equal(t, ErrInvalid{Path: "Order.Items[1]", Err: errNegative}, th.UnmarshalInto(b, &Order{}, Merge))
+}
+
+func TestProjection(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Order)(nil), (*Defaults)(nil), (*PersonV2)(nil)))
+
+	note := "n"
+	b, err := th.Marshal(&Order{
+		ID:    "a",
+		Items: []OrderItem{{SKU: "x", Qty: 1}, {SKU: "y", Qty: 2}},
+		Note:  &note,
+	}, nil)
+	assert.NoError(t, err)
+
+	// required fields that are not selected are not checked
+	p, err := th.Projection(27, "Items.Qty", "Note")
+	assert.NoError(t, err)
+	i, err := p.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Order{
+		Items: []OrderItem{{Qty: 1}, {Qty: 2}},
+		Note:  &note,
+	}, i)
+
+	i, err = th.UnmarshalFields(b, "Items.SKU", "Items")
+	assert.NoError(t, err)
+	assert.Equal(t, &Order{
+		Items: []OrderItem{{SKU: "x", Qty: 1}, {SKU: "y", Qty: 2}},
+	}, i)
+
+	// defaults are set on selected fields
+	b, err = th.Marshal(&Defaults{Port: 8080, Host: "h"}, nil)
+	assert.NoError(t, err)
+	i, err = th.UnmarshalFields(b, "Port", "Level")
+	assert.NoError(t, err)
+	assert.Equal(t, &Defaults{Port: 8080}, i)
+
+	b, err = th.Marshal(&PersonV2{
+		Name:    "Adam",
+		Address: &Bar{"b", 1},
+		Tags:    []string{"x"},
+	}, nil)
+	assert.NoError(t, err)
+	i, err = th.UnmarshalFields(b, "Address.Foo")
+	assert.NoError(t, err)
+	assert.Equal(t, &PersonV2{Address: &Bar{Foo: "b"}}, i)
+
+	_, err = th.Projection(27, "Items.Nope")
+	assert.Equal(t, ErrUnknownField{"thresher.Order.Items[].Nope"}, err)
+	_, err = th.Projection(27, "ID.Len")
+	assert.Equal(t, ErrUnknownField{"thresher.Order.ID.Len"}, err)
+	_, err = th.Projection(99)
+	assert.Equal(t, ErrNotFound{99}, err)
+	_, err = p.Unmarshal(b)
+	assert.IsType(t, ErrTypeMismatch{}, err)
+	_, err = (&Thresher{TrackRefs: true}).Projection(27)
+	assert.Error(t, err)
+}
+
+type LazyEnvelope struct {
+	ID   int              `RyeField:"1"`
+	Body Lazy[PersonV2]   `RyeField:"2"`
+	Tags Lazy[[]string]   `RyeField:"3"`
+	Meta []Lazy[Defaults] `RyeField:"4"`
+}
+
+func (*LazyEnvelope) TypeID() uint64 { return 28 }
+
+// EagerEnvelope has the same fields as LazyEnvelope without Lazy.
+type EagerEnvelope struct {
+	ID   int        `RyeField:"1"`
+	Body PersonV2   `RyeField:"2"`
+	Tags []string   `RyeField:"3"`
+	Meta []Defaults `RyeField:"4"`
+}
+
+func (*EagerEnvelope) TypeID() uint64 { return 28 }
+
+func TestLazy(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*LazyEnvelope)(nil)))
+	eager := &Thresher{}
+	assert.NoError(t, eager.Register((*EagerEnvelope)(nil)))
+
+	person := PersonV2{
+		Name:    "Adam",
+		Address: &Bar{"b", 1},
+		Tags:    []string{"x"},
+	}
+	e := &LazyEnvelope{ID: 1}
+	e.Body.Set(person)
+	e.Tags.Set([]string{"a", "b"})
+	e.Meta = make([]Lazy[Defaults], 1)
+	b, err := th.Marshal(e, nil)
+	assert.NoError(t, err)
+
+	// the data is the same as without Lazy
+	eb, err := eager.Marshal(&EagerEnvelope{
+		ID:   1,
+		Body: person,
+		Tags: []string{"a", "b"},
+		Meta: make([]Defaults, 1),
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, eb, b)
+
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	got := i.(*LazyEnvelope)
+	// values that are not used are written as they were read
+	rb, err := th.Marshal(got, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, b, rb)
+
+	p, err := got.Body.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, person, p)
+	tags, err := got.Tags.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, tags)
+	d, err := got.Meta[0].Get()
+	assert.NoError(t, err)
+	assert.Equal(t, Defaults{}, d)
+	got.Tags.Set(nil)
+	rb, err = th.Marshal(got, nil)
+	assert.NoError(t, err)
+	i, _, err = eager.Unmarshal(rb)
+	assert.NoError(t, err)
+	assert.Equal(t, &EagerEnvelope{
+		ID:   1,
+		Body: person,
+		Meta: make([]Defaults, 1),
+	}, i)
+
+	var empty Lazy[PersonV2]
+	p, err = empty.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, PersonV2{}, p)
+
+	s, err := th.Schema(28)
+	assert.NoError(t, err)
+	es, err := eager.Schema(28)
+	assert.NoError(t, err)
+	assert.Equal(t, es.Structs[1:], s.Structs[1:])
+
+	type LazyPtr struct {
+		P Lazy[*Bar] `RyeField:"1"`
+	}
+	err = th.RegisterNamed("lazy pointer", (*LazyPtr)(nil))
+	assert.IsType(t, ErrUnsupported{}, err)
+	assert.Equal(t, errLazyRefs, (&Thresher{TrackRefs: true}).Register((*LazyEnvelope)(nil)))
+}
+
+func TestPatch(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*PersonV2)(nil), (*Defaults)(nil), (*Foo)(nil)))
+
+	p := &PersonV2{
+		Name: "Adam",
+		Age:  30,
+		Tags: []string{"a"},
+	}
+	b, err := th.Marshal(p, nil)
+	assert.NoError(t, err)
+	orig := append([]byte(nil), b...)
+
+	// each patch gives the same data as setting the field and marshalling
+	for _, tc := range []struct {
+		name  string
+		id    uint64
+		value interface{}
+		set   func(p *PersonV2)
+	}{
+		{"replace", 2, 31, func(p *PersonV2) { p.Age = 31 }},
+		{"insert", 3, "Ad", func(p *PersonV2) { p.Nick = "Ad" }},
+		{"insert last", 300, []byte{1, 2}, func(p *PersonV2) { p.Raw = []byte{1, 2} }},
+		{"pointer", 7, &Bar{"b", 1}, func(p *PersonV2) { p.Address = &Bar{"b", 1} }},
+		{"interface", 10, &Foo{"c"}, func(p *PersonV2) { p.Favorite = &Foo{"c"} }},
+		{"zero", 2, 0, func(p *PersonV2) { p.Age = 0 }},
+		{"nil", 8, nil, func(p *PersonV2) { p.Tags = nil }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := th.Patch(b, 11, tc.id, tc.value)
+			assert.NoError(t, err)
+			cp := *p
+			tc.set(&cp)
+			want, err := th.Marshal(&cp, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.Equal(t, orig, b)
+		})
+	}
+
+	// a field equal to its default is removed, an always field is kept
+	d := &Defaults{Port: 1, Level: 5}
+	b, err = th.Marshal(d, nil)
+	assert.NoError(t, err)
+	b, err = th.Patch(b, 26, 1, 8080)
+	assert.NoError(t, err)
+	b, err = th.Patch(b, 26, 4, uint8(3))
+	assert.NoError(t, err)
+	want, err := th.Marshal(&Defaults{Port: 8080, Level: 3}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, b)
+
+	// fields that are not known are kept
+	older := &Thresher{}
+	assert.NoError(t, older.Register((*PersonV1)(nil)))
+	p.Nick = "Ad"
+	b, err = th.Marshal(p, nil)
+	assert.NoError(t, err)
+	b, err = older.Patch(b, 11, 2, 31)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	p.Age = 31
+	assert.Equal(t, p, i)
+	_, err = older.Patch(b, 11, 3, "Ad")
+	assert.Equal(t, ErrNoField{Struct: "thresher.PersonV1", ID: 3}, err)
+
+	_, err = th.Patch(b, 11, 2, "31")
+	assert.Error(t, err)
+	_, err = th.Patch(b, 26, 1, 1)
+	assert.Equal(t, ErrTypeMismatch{Want: 26, Got: 11}, err)
+	_, err = th.Patch(b, 1000, 1, 1)
+	assert.Equal(t, ErrNotFound{1000}, err)
+	_, err = th.Patch(b[:len(b)-1], 11, 9, nil)
+	assert.IsType(t, ErrMalformed{}, err)
+	_, err = (&Thresher{TrackRefs: true}).Patch(b, 11, 2, 31)
+	assert.Equal(t, errPatchRefs, err)
+}
+
+func TestNilSlices(t *testing.T) {
+	s := &Slices{
+		Ints:   []int{},
+		Nested: [][]int{nil, {}, {1}},
+		Ptr:    &[]string{},
+		Bytes:  []byte{},
+	}
+
+	// by default nil and empty slices are the same and decode as nil
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Slices)(nil)))
+	b, err := th.Marshal(s, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Slices{
+		Nested: [][]int{nil, nil, {1}},
+		Ptr:    new([]string),
+	}, i)
+
+	nth := &Thresher{NilSlices: true}
+	assert.NoError(t, nth.Register((*Slices)(nil)))
+	nb, err := nth.Marshal(s, nil)
+	assert.NoError(t, err)
+	i, _, err = nth.Unmarshal(nb)
+	assert.NoError(t, err)
+	assert.Equal(t, s, i)
+	got := i.(*Slices)
+	assert.Nil(t, got.Nested[0])
+	assert.NotNil(t, got.Nested[1])
+
+	// without NilSlices a nil slice is written as an empty one
+	i, _, err = nth.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Slices{
+		Nested: [][]int{{}, {}, {1}},
+		Ptr:    &[]string{},
+	}, i)
+
+	// data written with NilSlices can be read without it
+	i, _, err = th.Unmarshal(nb)
+	assert.NoError(t, err)
+	assert.Equal(t, &Slices{
+		Nested: [][]int{nil, nil, {1}},
+		Ptr:    new([]string),
+	}, i)
+
+	d, err := DecodeDynamic(nb, nth.Schemas()...)
+	assert.NoError(t, err)
+	nested, _ := d.(DynamicInterface).Value.(DynamicStruct).Field(2)
+	assert.Equal(t, []interface{}{[]interface{}(nil), []interface{}{}, []interface{}{int64(1)}}, nested)
+
+	// a []byte that is not a struct field is prefixed by its byte length so
+	// that a nil one is kept
+	type Blobs struct {
+		Blobs [][]byte `RyeField:"1"`
+		Ptr   *[]byte  `RyeField:"2"`
+		Bytes []byte   `RyeField:"3"`
+	}
+	bth := &Thresher{NilSlices: true}
+	assert.NoError(t, bth.RegisterNamed("blobs", (*Blobs)(nil)))
+	bs := &Blobs{
+		Blobs: [][]byte{nil, {}, {1, 2}},
+		Ptr:   new([]byte),
+		Bytes: []byte{},
+	}
+	b, err = bth.Marshal(bs, nil)
+	assert.NoError(t, err)
+	i, _, err = bth.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, bs, i)
+	gotBlobs := i.(*Blobs)
+	assert.Nil(t, gotBlobs.Blobs[0])
+	assert.NotNil(t, gotBlobs.Blobs[1])
+	assert.Nil(t, *gotBlobs.Ptr)
+	assert.NotNil(t, gotBlobs.Bytes)
+
+	*bs.Ptr = []byte{}
+	b, err = bth.Marshal(bs, nil)
+	assert.NoError(t, err)
+	i, _, err = bth.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.NotNil(t, *i.(*Blobs).Ptr)
+
+	schemas := bth.Schemas()
+	d, err = DecodeDynamic(b, schemas...)
+	assert.NoError(t, err)
+	blobs, _ := d.(DynamicInterface).Value.(DynamicStruct).Field(1)
+	assert.Equal(t, []interface{}{[]byte(nil), []byte{}, []byte{1, 2}}, blobs)
+	assert.Nil(t, blobs.([]interface{})[0])
+
+	// the Schema marks the []byte values that are not struct fields
+	ss := schemas[0].Structs[schemas[0].Type.Elem.Struct]
+	assert.True(t, ss.Fields[0].Type.Elem.NilSlices)
+	assert.True(t, ss.Fields[1].Type.Elem.NilSlices)
+	assert.False(t, ss.Fields[2].Type.NilSlices)
+	encoded, err := rye.Marshal(schemas[0])
+	assert.NoError(t, err)
+	parsed, err := ParseSchema(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, schemas[0], parsed)
+
+	dth := &Thresher{}
+	assert.NoError(t, dth.RegisterNamed("blobs", (*Blobs)(nil)))
+	r := CheckCompatible(schemas[0], dth.Schemas()[0])
+	assert.Equal(t, []Issue{
+		{Struct: "thresher.Blobs", ID: 1, Reason: "nil and empty []byte are encoded differently"},
+		{Struct: "thresher.Blobs", ID: 2, Reason: "nil and empty []byte are encoded differently"},
+	}, r.Issues)
+}
+
 const (
 	sflag uint64 = (1 << 63) - 1
 )
 
+type Stringers struct {
+	Items []fmt.Stringer `RyeField:"1"`
+}
+
+func (*Stringers) TypeID() uint64 { return 25 }
+
+func TestNilInterfaceElem(t *testing.T) {
+	th := &Thresher{}
+	assert.NoError(t, th.Register((*Stringers)(nil), (*Foo)(nil), (*Person)(nil)))
+
+	s := &Stringers{Items: []fmt.Stringer{&Foo{"a"}, nil, &Foo{"b"}}}
+	b, err := th.Marshal(s, nil)
+	assert.NoError(t, err)
+	i, _, err := th.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, s, i)
+
+	out, err := DecodeDynamic(b, th.Schemas()...)
+	assert.NoError(t, err)
+	items, _ := out.(DynamicInterface).Value.(DynamicStruct).ByName("Items")
+	assert.Nil(t, items.([]interface{})[1])
+
+	// a TypeID whose type does not implement the interface
+	foo, err := th.Marshal(&Foo{"a"}, nil)
+	assert.NoError(t, err)
+	idx := bytes.Index(b, foo)
+	assert.True(t, idx > 0)
+	b[idx] = 128 | 2
+	_, _, err = th.Unmarshal(b)
+	assert.Equal(t, ErrMalformed{"*thresher.Person does not implement fmt.Stringer"}, err)
+}
+
 func TestFloat(t *testing.T) {
 	t.Skip() // looking into better way to compress a float
 	f := 1.5
@@ -262,6 +1592,45 @@ func BenchmarkRye(b *testing.B) {
 	}
 }
 
+func BenchmarkProjection(b *testing.B) {
+	th := &Thresher{}
+	th.Register((*AllTypes)(nil), (*Foo)(nil))
+
+	iPtr := 123
+	data, _ := th.Marshal(&AllTypes{
+		Int:       1,
+		Uint64:    11,
+		Float64:   3.141592653,
+		PtrInt:    &iPtr,
+		Interface: &Foo{"a", "b", "c", "d"},
+	}, nil)
+	p, _ := th.Projection(4, "Int", "Uint64")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p.Unmarshal(data)
+	}
+}
+
+func BenchmarkPatch(b *testing.B) {
+	th := &Thresher{}
+	th.Register((*AllTypes)(nil), (*Foo)(nil))
+
+	iPtr := 123
+	data, _ := th.Marshal(&AllTypes{
+		Int:       1,
+		Uint64:    11,
+		Float64:   3.141592653,
+		PtrInt:    &iPtr,
+		Interface: &Foo{"a", "b", "c", "d"},
+	}, nil)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		th.Patch(data, 4, 1, n)
+	}
+}
+
 func BenchmarkGob(b *testing.B) {
 	iPtr := 123
 	ai := &AllTypes{
@@ -4,4 +4,6 @@ type HasType interface {
 	TypeID() uint64
 }
 
+// DefaultSliceThreshold is the most elements allowed in a slice by Unmarshal
+// when Limits.MaxSliceLen is not set.
 var DefaultSliceThreshold uint64 = 1 << 15
@@ -0,0 +1,104 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// MarshalAs marshals v as its registered type, which may be either *T or T.
+// The output is the same as Marshal but T does not need to implement HasType.
+func MarshalAs[T any](th *Thresher, v *T) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = toErr(r)
+		}
+	}()
+	reg := th.load()
+	id, m, ptr := reg.lookupType(reflect.TypeOf(v))
+	if m == nil {
+		return nil, ErrNotRegistered{reflect.TypeOf(v).String()}
+	}
+	if v == nil && !ptr {
+		return nil, fmt.Errorf("thresher: cannot marshal a nil %s as %s", reflect.TypeOf(v), reflect.TypeOf(v).Elem())
+	}
+	base := unsafe.Pointer(v)
+	if ptr {
+		base = unsafe.Pointer(&v)
+	}
+	return th.marshal(reg, id, m, base, nil), nil
+}
+
+// UnmarshalInto decodes data into v, which must not be nil, instead of
+// allocating a new value. The registered type may be either *T or T. If data
+// holds a different type ErrTypeMismatch is returned. v is reset before it is
+// decoded so fields that are not in the data are left zero; if data holds a
+// nil pointer v is left zero.
+func UnmarshalInto[T any](th *Thresher, data []byte, v *T) error {
+	return th.unmarshalInto(data, reflect.TypeOf(v), unsafe.Pointer(v), Overwrite)
+}
+
+// DecodeMode controls how Thresher.UnmarshalInto treats fields of the value
+// being decoded into that are not in the data.
+type DecodeMode byte
+
+const (
+	// Overwrite resets the value before decoding so that it holds only what
+	// is in the data.
+	Overwrite DecodeMode = iota
+	// Merge keeps fields that are not in the data, like Merge in protobuf.
+	// Fields that are in the data replace the existing value except for
+	// structs and non-nil pointers to structs which are merged field by
+	// field. Slices and interfaces are replaced rather than appended.
+	Merge
+)
+
+// UnmarshalInto decodes data into v, which must be a non-nil pointer to a
+// registered type, instead of allocating a new value. If data holds a
+// different type ErrTypeMismatch is returned. The mode determines what happens
+// to fields of v that are not in the data.
+func (t *Thresher) UnmarshalInto(data []byte, v HasType, mode DecodeMode) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("thresher: UnmarshalInto requires a non-nil pointer, got %T", v)
+	}
+	return t.unmarshalInto(data, rv.Type(), rv.UnsafePointer(), mode)
+}
+
+// unmarshalInto decodes data into the value at p of type pt.Elem().
+func (t *Thresher) unmarshalInto(data []byte, pt reflect.Type, p unsafe.Pointer, mode DecodeMode) (err error) {
+	defer recoverUnmarshal(&err)
+	reg := t.load()
+	want, m, ptr := reg.lookupType(pt)
+	if m == nil {
+		return ErrNotRegistered{pt.String()}
+	}
+	d := newDecoder(data, t, reg)
+	d.merge = mode == Merge
+	if got := d.CompactUint64(); got != want {
+		return ErrTypeMismatch{Want: want, Got: got}
+	}
+	v := reflect.NewAt(pt.Elem(), p).Elem()
+	if !d.merge {
+		v.Set(reflect.Zero(pt.Elem()))
+	}
+	if d.checks {
+		defer recoverRoot(pt)
+	}
+	d.mergeInto = d.merge
+	if !ptr {
+		m.op.unmarshal(p, d)
+		return nil
+	}
+	if pm, ok := m.op.(ptrMarshaller); ok {
+		pm.unmarshalInto(p, d)
+		return nil
+	}
+	// the pointer type encodes itself
+	cell := reflect.New(pt)
+	m.op.unmarshal(cell.UnsafePointer(), d)
+	if !cell.Elem().IsNil() {
+		v.Set(cell.Elem().Elem())
+	}
+	return nil
+}
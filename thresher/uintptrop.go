@@ -1,253 +1,637 @@
 package thresher
 
 import (
+	"fmt"
 	"github.com/adamcolton/rye"
 	"reflect"
 	"unsafe"
 )
 
-const (
-	ifcePtrOffset uintptr = 8
-)
+// ifaceWords is the layout of an interface value, a type word followed by a
+// data word. If the dynamic type is a pointer the data word is the pointer.
+type ifaceWords struct {
+	typ, data unsafe.Pointer
+}
+
+// ifaceDataOffset is the offset of the data word, which is the size of a
+// pointer on the target.
+const ifaceDataOffset = unsafe.Offsetof(ifaceWords{}.data)
+
+// direct reports whether a value of rt is stored in the data word of an
+// interface rather than pointed to by it. This is true of pointer shaped
+// types, following the rule the compiler uses.
+func direct(rt reflect.Type) bool {
+	switch rt.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	case reflect.Struct:
+		return rt.NumField() == 1 && direct(rt.Field(0).Type)
+	case reflect.Array:
+		return rt.Len() == 1 && direct(rt.Elem())
+	}
+	return false
+}
+
+// ifaceData returns a pointer to the dynamic value of the interface at u. A
+// value that is not direct is read where the interface points to rather than
+// copied, so it must not be modified.
+func ifaceData(u unsafe.Pointer, direct bool) unsafe.Pointer {
+	if direct {
+		return unsafe.Add(u, ifaceDataOffset)
+	}
+	return (*ifaceWords)(u).data
+}
+
+// widener is implemented by ops that can decode a narrower type that was
+// written with a different wire type, such as an int8 field that has been
+// changed to an int64. If the wire type cannot be converted, widen returns
+// false without reading.
+type widener interface {
+	widen(wt wireType, u unsafe.Pointer, d *decoder) bool
+}
 
 type uintPtrOp interface {
-	size(u uintptr) int
-	marshal(u uintptr, s *rye.Serializer)
-	unmarshal(u uintptr, d *rye.Deserializer)
-	zero(u uintptr) bool
+	size(u unsafe.Pointer, s *encoder) int
+	marshal(u unsafe.Pointer, s *encoder)
+	unmarshal(u unsafe.Pointer, d *decoder)
+	zero(u unsafe.Pointer) bool
+	wireType() wireType
 }
 
-func (p ptrMarshaller) size(u uintptr) int {
+func (p ptrMarshaller) size(u unsafe.Pointer, s *encoder) int {
 	size := 1
-	u = *(*uintptr)(unsafe.Pointer(u))
-	if u != 0 {
-		size += p.op.size(u)
+	u = *(*unsafe.Pointer)(u)
+	if u == nil {
+		return size
 	}
-	return size
+	if s.refs != nil {
+		if id, seen := s.ref(u, p.t); seen {
+			return rye.CompactUint64Size(id + 1)
+		}
+	}
+	return size + p.op.size(u, s)
 }
 
-func (p ptrMarshaller) zero(u uintptr) bool {
-	return *(*uintptr)(unsafe.Pointer(u)) == 0
+func (p ptrMarshaller) zero(u unsafe.Pointer) bool {
+	return *(*unsafe.Pointer)(u) == nil
 }
 
-func (p ptrMarshaller) marshal(u uintptr, s *rye.Serializer) {
-	u = *(*uintptr)(unsafe.Pointer(u))
-	if u == 0 {
-		s.Byte(0)
+// marshal writes a presence byte followed by the value. When tracking
+// references the presence byte is a Compact Uint64; 0 is nil, 1 is followed by
+// the value and any other value is one more than the ID of a pointer that has
+// already been written.
+func (p ptrMarshaller) marshal(u unsafe.Pointer, s *encoder) {
+	u = *(*unsafe.Pointer)(u)
+	if s.refs == nil {
+		if u == nil {
+			s.Byte(0)
+		} else {
+			s.Byte(1)
+			p.op.marshal(u, s)
+		}
+		return
+	}
+	if u == nil {
+		s.CompactUint64(0)
+	} else if id, seen := s.ref(u, p.t); seen {
+		s.CompactUint64(id + 1)
 	} else {
-		s.Byte(1)
+		s.CompactUint64(1)
 		p.op.marshal(u, s)
 	}
 }
 
-func (p ptrMarshaller) unmarshal(u uintptr, d *rye.Deserializer) {
-	if d.Byte() == 0 {
+func (p ptrMarshaller) unmarshal(u unsafe.Pointer, d *decoder) {
+	if !d.trackRefs {
+		if d.Byte() == 0 {
+			return
+		}
+		p.unmarshalValue(u, d)
 		return
 	}
+	switch ref := d.CompactUint64(); ref {
+	case 0:
+	case 1:
+		p.unmarshalValue(u, d)
+	default:
+		d.backRef(u, ref-1, p.t)
+	}
+}
+
+// wireType is the wire type of the value that follows the presence byte.
+// ptrMarshaller is never used directly as a struct field, see
+// ptrFieldMarshaller.
+func (p ptrMarshaller) wireType() wireType {
+	return p.op.wireType()
+}
+
+// unmarshalInto decodes into the value at u, which is not nil, instead of
+// allocating. It is used for a root value provided by the caller so it can
+// never be a back reference.
+func (p ptrMarshaller) unmarshalInto(u unsafe.Pointer, d *decoder) {
+	if !d.trackRefs {
+		if d.Byte() != 0 {
+			p.op.unmarshal(u, d)
+		}
+		return
+	}
+	switch d.CompactUint64() {
+	case 0:
+	case 1:
+		d.addRef(reflect.NewAt(p.t, u))
+		p.op.unmarshal(u, d)
+	default:
+		panic(ErrMalformed{"bad reference"})
+	}
+}
 
-	i := reflect.New(p.t).Elem().Interface()
-	base := *(*uintptr)(unsafe.Pointer(uintptr(unsafe.Pointer(&i)) + ifcePtrOffset))
+// unmarshalValue allocates a new value, unmarshals into it and sets the pointer
+// at u. When merging, an existing struct is decoded into instead.
+func (p ptrMarshaller) unmarshalValue(u unsafe.Pointer, d *decoder) {
+	if existing := *(*unsafe.Pointer)(u); d.merge && existing != nil && p.t.Kind() == reflect.Struct {
+		d.addRef(reflect.NewAt(p.t, existing))
+		d.mergeInto = true
+		p.op.unmarshal(existing, d)
+		return
+	}
+	d.alloc(uint64(p.t.Size()))
+	v := reflect.New(p.t)
+	d.addRef(v)
+	base := v.UnsafePointer()
 	p.op.unmarshal(base, d)
-	*(*uintptr)(unsafe.Pointer(u)) = base
+	*(*unsafe.Pointer)(u) = base
 }
 
-func (i interfaceMarshaller) zero(u uintptr) bool {
-	return *(*uintptr)(unsafe.Pointer(u)) == 0
+func (p ptrFieldMarshaller) size(u unsafe.Pointer, s *encoder) int {
+	return p.op.size(*(*unsafe.Pointer)(u), s)
 }
 
-func (i interfaceMarshaller) size(u uintptr) int {
-	tid := reflect.NewAt(i.rt, unsafe.Pointer(u)).Elem().Interface().(HasType).TypeID()
-	m := i.t.typedIDMarshallers[tid]
-	return rye.CompactUint64Size(tid) + m.op.size(u+ifcePtrOffset)
+func (p ptrFieldMarshaller) zero(u unsafe.Pointer) bool {
+	return *(*unsafe.Pointer)(u) == nil
 }
 
-func (i interfaceMarshaller) marshal(u uintptr, s *rye.Serializer) {
-	tid := reflect.NewAt(i.rt, unsafe.Pointer(u)).Elem().Interface().(HasType).TypeID()
+func (p ptrFieldMarshaller) marshal(u unsafe.Pointer, s *encoder) {
+	p.op.marshal(*(*unsafe.Pointer)(u), s)
+}
 
-	m := i.t.typedIDMarshallers[tid]
+func (p ptrFieldMarshaller) unmarshal(u unsafe.Pointer, d *decoder) {
+	ptrMarshaller(p).unmarshalValue(u, d)
+}
+
+func (p ptrFieldMarshaller) wireType() wireType {
+	return p.op.wireType()
+}
+
+func (p ptrFieldMarshaller) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	w, ok := p.op.(widener)
+	if !ok {
+		return false
+	}
+	v := reflect.New(p.t)
+	if !w.widen(wt, v.UnsafePointer(), d) {
+		return false
+	}
+	reflect.NewAt(reflect.PtrTo(p.t), u).Elem().Set(v)
+	return true
+}
+
+func (i interfaceMarshaller) zero(u unsafe.Pointer) bool {
+	return *(*unsafe.Pointer)(u) == nil
+}
+
+// lookup returns the TypeID and marshaller of the dynamic type of the interface
+// at u and a pointer to its value.
+func (i interfaceMarshaller) lookup(u unsafe.Pointer, r *registry) (uint64, *marshaller, unsafe.Pointer) {
+	rt := reflect.NewAt(i.rt, u).Elem().Elem().Type()
+	tid, found := r.byType[rt]
+	if !found {
+		panic(ErrNotRegistered{rt.String()})
+	}
+	m := r.marshaller(tid)
+	return tid, m, ifaceData(u, m.direct)
+}
+
+// size of the interface. A non-nil value is written as its byte length, its
+// TypeID and the value. A nil interface that is written, such as an element
+// of a slice, has a byte length of 0 and nothing else.
+func (i interfaceMarshaller) size(u unsafe.Pointer, s *encoder) int {
+	if i.zero(u) {
+		return 1
+	}
+	idx := s.startSize()
+	tid, m, p := i.lookup(u, s.reg)
+	return s.endSize(idx, rye.CompactUint64Size(tid)+m.op.size(p, s))
+}
+
+func (i interfaceMarshaller) marshal(u unsafe.Pointer, s *encoder) {
+	if i.zero(u) {
+		s.CompactUint64(0)
+		return
+	}
+	tid, m, p := i.lookup(u, s.reg)
+	s.CompactUint64(s.nextSize())
 	s.CompactUint64(tid)
-	m.op.marshal(u+ifcePtrOffset, s)
+	m.op.marshal(p, s)
 }
 
-func (i interfaceMarshaller) unmarshal(u uintptr, d *rye.Deserializer) {
+func (i interfaceMarshaller) unmarshal(u unsafe.Pointer, d *decoder) {
+	r := reflect.NewAt(i.rt, u).Elem()
+	if d.CompactUint64() == 0 {
+		r.SetZero()
+		return
+	}
 	tid := d.CompactUint64()
-	m := i.t.typedIDMarshallers[tid]
-	ifce := reflect.New(m.t).Elem().Interface()
-	base := uintptr(unsafe.Pointer(&ifce)) + ifcePtrOffset
-	m.op.unmarshal(base, d)
+	m := d.reg.marshaller(tid)
+	if m == nil {
+		panic(ErrNotFound{tid})
+	}
+	if !m.t.Implements(i.rt) {
+		panic(ErrMalformed{fmt.Sprintf("%s does not implement %s", m.t, i.rt)})
+	}
+	v := reflect.New(m.t)
+	m.op.unmarshal(v.UnsafePointer(), d)
+	r.Set(v.Elem())
+}
+
+func (interfaceMarshaller) wireType() wireType {
+	return wireBytes
+}
 
-	r := reflect.NewAt(i.rt, unsafe.Pointer(u))
-	r.Elem().Set(reflect.ValueOf(ifce))
+// delimited prefixes the value with its size.
+type delimited struct {
+	op uintPtrOp
 }
 
-type uintPtrOpByteSlice struct{}
+func (dl delimited) size(u unsafe.Pointer, s *encoder) int {
+	idx := s.startSize()
+	return s.endSize(idx, dl.op.size(u, s))
+}
+
+func (dl delimited) zero(u unsafe.Pointer) bool {
+	return dl.op.zero(u)
+}
 
-func (uintPtrOpByteSlice) size(u uintptr) int {
-	ln := len(*(*[]byte)(unsafe.Pointer(u)))
+func (dl delimited) marshal(u unsafe.Pointer, s *encoder) {
+	s.CompactUint64(s.nextSize())
+	dl.op.marshal(u, s)
+}
+
+func (dl delimited) unmarshal(u unsafe.Pointer, d *decoder) {
+	d.CompactUint64()
+	dl.op.unmarshal(u, d)
+}
+
+func (delimited) wireType() wireType {
+	return wireBytes
+}
+
+// uintPtrOpByteSlice is a length and the bytes. A length of 0 is decoded as
+// nil unless nilSlices is set. A nil []byte struct field is not written, but
+// with nilSlices any other []byte is nested: it is written as sliceMarshaller
+// does, prefixed by its byte length, so that a byte length of 0 is nil.
+type uintPtrOpByteSlice struct {
+	nilSlices bool
+	nested    bool
+}
+
+func (bs uintPtrOpByteSlice) size(u unsafe.Pointer, s *encoder) int {
+	b := *(*[]byte)(u)
+	ln := len(b) + rye.CompactUint64Size(uint64(len(b)))
+	if !bs.nested {
+		return ln
+	}
+	if b == nil {
+		return 1
+	}
 	return ln + rye.CompactUint64Size(uint64(ln))
 }
 
-func (uintPtrOpByteSlice) zero(u uintptr) bool {
-	return len(*(*[]byte)(unsafe.Pointer(u))) == 0
+func (bs uintPtrOpByteSlice) zero(u unsafe.Pointer) bool {
+	if bs.nilSlices {
+		return *(*[]byte)(u) == nil
+	}
+	return len(*(*[]byte)(u)) == 0
 }
 
-func (uintPtrOpByteSlice) marshal(u uintptr, s *rye.Serializer) {
-	b := *(*[]byte)(unsafe.Pointer(u))
+func (bs uintPtrOpByteSlice) marshal(u unsafe.Pointer, s *encoder) {
+	b := *(*[]byte)(u)
+	if bs.nested {
+		if b == nil {
+			s.CompactUint64(0)
+			return
+		}
+		s.CompactUint64(uint64(len(b) + rye.CompactUint64Size(uint64(len(b)))))
+	}
 	s.CompactUint64(uint64(len(b)))
 	s.Slice(b)
 }
-func (uintPtrOpByteSlice) unmarshal(u uintptr, d *rye.Deserializer) {
-	ln := int(d.CompactUint64())
-	b := (*[]byte)(unsafe.Pointer(u))
-	*b = d.Slice(ln)
+func (bs uintPtrOpByteSlice) unmarshal(u unsafe.Pointer, d *decoder) {
+	b := (*[]byte)(u)
+	end := -1
+	if bs.nested {
+		size := d.CompactUint64()
+		if size == 0 {
+			*b = nil
+			return
+		}
+		if size > uint64(len(d.Data)-d.Idx) {
+			panic(ErrMalformed{"slice length exceeds data"})
+		}
+		end = d.Idx + int(size)
+	}
+	ln := d.CompactUint64()
+	d.stringLen(ln)
+	if ln == 0 && bs.nilSlices {
+		*b = []byte{}
+	} else {
+		*b = append([]byte(nil), d.Slice(int(ln))...)
+	}
+	if end >= 0 && d.Idx != end {
+		panic(ErrMalformed{"slice length does not match contents"})
+	}
+}
+
+func (uintPtrOpByteSlice) wireType() wireType {
+	return wireBytes
 }
 
 type uintPtrOpString struct{}
 
-func (uintPtrOpString) size(u uintptr) int {
-	s := *(*string)(unsafe.Pointer(u))
-	ln := len(s)
+func (uintPtrOpString) size(u unsafe.Pointer, s *encoder) int {
+	ln := len(*(*string)(u))
 	return ln + rye.CompactUint64Size(uint64(ln))
 }
 
-func (uintPtrOpString) zero(u uintptr) bool {
-	return len(*(*string)(unsafe.Pointer(u))) == 0
+func (uintPtrOpString) zero(u unsafe.Pointer) bool {
+	return len(*(*string)(u)) == 0
 }
 
-func (uintPtrOpString) marshal(u uintptr, s *rye.Serializer) {
-	str := *(*string)(unsafe.Pointer(u))
+func (uintPtrOpString) marshal(u unsafe.Pointer, s *encoder) {
+	str := *(*string)(u)
 	s.CompactUint64(uint64(len(str)))
 	s.String(str)
 }
 
-func (uintPtrOpString) unmarshal(u uintptr, d *rye.Deserializer) {
-	ln := int(d.CompactUint64())
-	str := (*string)(unsafe.Pointer(u))
-	*str = d.String(ln)
+func (uintPtrOpString) unmarshal(u unsafe.Pointer, d *decoder) {
+	ln := d.CompactUint64()
+	d.stringLen(ln)
+	str := (*string)(u)
+	*str = d.String(int(ln))
 }
 
-func (sm structMarshaller) size(base uintptr) int {
+func (uintPtrOpString) wireType() wireType {
+	return wireBytes
+}
+
+func (sm structMarshaller) size(base unsafe.Pointer, s *encoder) int {
 	size := 1
 	for _, f := range sm.byOrder {
-		if f.fieldHeader == 0 || f.zero(base+f.offset) {
+		if f.omit(unsafe.Add(base, f.offset)) {
 			continue
 		}
 		size += rye.CompactUint64Size(f.fieldHeader)
-		size += f.size(base + f.offset)
+		size += f.size(unsafe.Add(base, f.offset), s)
+	}
+	if sm.hasUnknown {
+		size += len(*(*UnknownFields)(unsafe.Add(base, sm.unknown)))
 	}
 	return size
 }
 
-func (sm structMarshaller) zero(base uintptr) bool {
+func (sm structMarshaller) zero(base unsafe.Pointer) bool {
 	for _, f := range sm.byOrder {
 		if f.fieldHeader == 0 {
 			continue
 		}
-		if !f.zero(base + f.offset) {
+		if !f.zero(unsafe.Add(base, f.offset)) {
 			return false
 		}
 	}
 	return true
 }
 
-func (sm structMarshaller) marshal(base uintptr, s *rye.Serializer) {
+func (sm structMarshaller) marshal(base unsafe.Pointer, s *encoder) {
 	for _, f := range sm.byOrder {
-		if f.fieldHeader == 0 || f.zero(base+f.offset) {
+		if f.omit(unsafe.Add(base, f.offset)) {
 			continue
 		}
 		s.CompactUint64(f.fieldHeader)
-		f.marshal(base+f.offset, s)
+		f.marshal(unsafe.Add(base, f.offset), s)
+	}
+	if sm.hasUnknown {
+		s.Slice(*(*UnknownFields)(unsafe.Add(base, sm.unknown)))
 	}
 	s.CompactInt64(0)
 }
 
-func (sm structMarshaller) unmarshal(base uintptr, d *rye.Deserializer) {
+// unmarshal decodes the fields in the data. Unless the struct is being merged
+// into, fields with defaults are set first and required fields are checked
+// after.
+func (sm structMarshaller) unmarshal(base unsafe.Pointer, d *decoder) {
+	d.enter()
+	var field string
+	if d.checks {
+		defer recoverField(&field)
+	}
+	var seen uint64
+	mergeInto := d.mergeInto
+	d.mergeInto = false
+	if !mergeInto {
+		sm.setDefaults(base)
+	}
 	for {
-		field := d.CompactUint64()
-		if field == 0 {
+		start := d.Idx
+		header := d.CompactUint64()
+		if header == 0 {
 			break
 		}
-		sf := sm.byId[field]
-		sf.unmarshal(base+sf.offset, d)
+		id, wt := splitHeader(header)
+		if id < uint64(len(sm.byId)) {
+			if sf := sm.byId[id]; sf.fieldHeader == header {
+				// a nested struct is part of the value being merged into
+				d.mergeInto = mergeInto && sf.rt.Kind() == reflect.Struct
+				field = sf.name
+				sf.unmarshal(unsafe.Add(base, sf.offset), d)
+				seen |= sf.requiredBit()
+				continue
+			} else if sf.fieldHeader != 0 {
+				field = sf.name
+				if w, ok := sf.uintPtrOp.(widener); !ok || !w.widen(wt, unsafe.Add(base, sf.offset), d) {
+					panic(ErrIncompatible{
+						Struct: sm.rt.String(),
+						ID:     id,
+						Got:    wt.String(),
+						Want:   sf.wireType().String(),
+					})
+				}
+				seen |= sf.requiredBit()
+				continue
+			}
+		}
+		if d.trackRefs {
+			// the writer numbered any pointers in the field, so skipping it
+			// would resolve every later reference to the wrong pointer
+			panic(ErrSkipRefs{Struct: sm.rt.String(), ID: id})
+		}
+		d.skip(wt)
+		if sm.hasUnknown {
+			uf := (*UnknownFields)(unsafe.Add(base, sm.unknown))
+			*uf = append(*uf, d.Data[start:d.Idx]...)
+		}
 	}
+	d.mergeInto = false
+	field = ""
+	if d.checks {
+		sm.checkFields(base, seen, mergeInto)
+	}
+	d.exit()
+}
+
+func (structMarshaller) wireType() wireType {
+	return wireGroup
 }
 
 type uintPtrOpSkip struct{}
 
-func (uintPtrOpSkip) size(u uintptr) int {
+func (uintPtrOpSkip) size(u unsafe.Pointer, s *encoder) int {
 	return 0
 }
-func (uintPtrOpSkip) zero(u uintptr) bool {
+func (uintPtrOpSkip) zero(u unsafe.Pointer) bool {
 	return true
 }
-func (uintPtrOpSkip) marshal(u uintptr, s *rye.Serializer)     {}
-func (uintPtrOpSkip) unmarshal(u uintptr, d *rye.Deserializer) {}
-
-func (sm sliceMarshaller) size(base uintptr) int {
-	s := *(*[]byte)(unsafe.Pointer(base)) // use []byte, type doesn't actually matter
-	ln := uintptr(len(s))
-	first := uintptr(unsafe.Pointer(&(s[0])))
+func (uintPtrOpSkip) marshal(u unsafe.Pointer, s *encoder)   {}
+func (uintPtrOpSkip) unmarshal(u unsafe.Pointer, d *decoder) {}
+func (uintPtrOpSkip) wireType() wireType                     { return wireVarint }
+
+// size of the slice. A slice is written as its byte length, the number of
+// elements and the elements; with nilSlices a nil slice has a byte length of 0
+// and nothing else.
+func (sm sliceMarshaller) size(base unsafe.Pointer, s *encoder) int {
+	idx := s.startSize()
+	l := *(*[]byte)(base) // use []byte, type doesn't actually matter
+	if l == nil && sm.nilSlices {
+		return s.endSize(idx, 0)
+	}
+	ln := uintptr(len(l))
+	if uint64(ln) > s.maxSliceLen {
+		panic(ErrLimit{"MaxSliceLen", uint64(ln), s.maxSliceLen})
+	}
+	first := unsafe.Pointer(unsafe.SliceData(l))
 	size := rye.CompactUint64Size(uint64(ln))
 	for i := uintptr(0); i < ln; i++ {
-		size += sm.op.size(first + i*sm.recordLen)
+		size += sm.op.size(unsafe.Add(first, i*sm.recordLen), s)
 	}
-	return size
+	return s.endSize(idx, size)
 }
 
-func (sm sliceMarshaller) zero(base uintptr) bool {
-	return len(*(*[]byte)(unsafe.Pointer(base))) == 0
+func (sm sliceMarshaller) zero(base unsafe.Pointer) bool {
+	if sm.nilSlices {
+		return *(*[]byte)(base) == nil
+	}
+	return len(*(*[]byte)(base)) == 0
 }
 
-func (sm sliceMarshaller) marshal(base uintptr, s *rye.Serializer) {
-	l := *(*[]byte)(unsafe.Pointer(base)) // use []byte, type doesn't actually matter
+func (sm sliceMarshaller) marshal(base unsafe.Pointer, s *encoder) {
+	size := s.nextSize()
+	s.CompactUint64(size)
+	if size == 0 {
+		return
+	}
+	l := *(*[]byte)(base) // use []byte, type doesn't actually matter
 	ln := uintptr(len(l))
-	first := uintptr(unsafe.Pointer(&(l[0])))
+	first := unsafe.Pointer(unsafe.SliceData(l))
 	s.CompactUint64(uint64(ln))
 	for i := uintptr(0); i < ln; i++ {
-		sm.op.marshal(first+i*sm.recordLen, s)
+		sm.op.marshal(unsafe.Add(first, i*sm.recordLen), s)
 	}
 }
 
-func (sm sliceMarshaller) unmarshal(u uintptr, d *rye.Deserializer) {
-	ln := uintptr(d.CompactUint64())
-	s := make([]byte, ln*sm.recordLen)
-	first := uintptr(unsafe.Pointer(&(s[0])))
-	*(*int)(unsafe.Pointer(uintptr(unsafe.Pointer(&s)) + 8)) = int(ln)
-	*(*int)(unsafe.Pointer(uintptr(unsafe.Pointer(&s)) + 16)) = int(ln)
-	*(*[]byte)(unsafe.Pointer(u)) = s
-	for i := uintptr(0); i < ln; i++ {
-		sm.op.unmarshal(first+i*sm.recordLen, d)
+func (sm sliceMarshaller) unmarshal(u unsafe.Pointer, d *decoder) {
+	d.enter()
+	end := int(d.CompactUint64())
+	v := reflect.NewAt(sm.rt, u).Elem()
+	if end == 0 {
+		// a nil slice written with NilSlices; any Thresher decodes it
+		v.SetZero()
+		d.exit()
+		return
+	}
+	end += d.Idx
+	ln64 := d.CompactUint64()
+	d.sliceLen(ln64)
+	if ln64 == 0 && !sm.nilSlices {
+		v.SetZero()
+		if d.Idx != end {
+			panic(ErrMalformed{"slice length does not match contents"})
+		}
+		d.exit()
+		return
+	}
+	ln := uintptr(ln64)
+	d.alloc(uint64(ln * sm.recordLen))
+	// the slice is made with its type so that the garbage collector can see
+	// any pointers stored in it
+	s := reflect.MakeSlice(sm.rt, int(ln), int(ln))
+	v.Set(s)
+	first := s.UnsafePointer()
+	var i uintptr
+	if d.checks {
+		defer recoverElem(&i)
+	}
+	for ; i < ln; i++ {
+		sm.op.unmarshal(unsafe.Add(first, i*sm.recordLen), d)
+	}
+	if d.Idx != end {
+		panic(ErrMalformed{"slice length does not match contents"})
 	}
+	d.exit()
+}
+
+func (sliceMarshaller) wireType() wireType {
+	return wireBytes
 }
 
 type uintPtrOpFloat32 struct{}
 
-func (uintPtrOpFloat32) size(u uintptr) int {
+func (uintPtrOpFloat32) size(u unsafe.Pointer, s *encoder) int {
 	return 4
 }
 
-func (uintPtrOpFloat32) zero(u uintptr) bool {
-	return *(*float32)(unsafe.Pointer(u)) == 0
+func (uintPtrOpFloat32) zero(u unsafe.Pointer) bool {
+	return *(*float32)(u) == 0
 }
-func (uintPtrOpFloat32) marshal(u uintptr, s *rye.Serializer) {
-	s.Float32(*(*float32)(unsafe.Pointer(u)))
+func (uintPtrOpFloat32) marshal(u unsafe.Pointer, s *encoder) {
+	s.Float32(*(*float32)(u))
 }
-func (uintPtrOpFloat32) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*float32)(unsafe.Pointer(u)) = d.Float32()
+func (uintPtrOpFloat32) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*float32)(u) = d.Float32()
+}
+func (uintPtrOpFloat32) wireType() wireType {
+	return wireFixed32
 }
 
 type uintPtrOpFloat64 struct{}
 
-func (uintPtrOpFloat64) size(u uintptr) int {
+func (uintPtrOpFloat64) size(u unsafe.Pointer, s *encoder) int {
 	return 8
 }
 
-func (uintPtrOpFloat64) zero(u uintptr) bool {
-	return *(*float64)(unsafe.Pointer(u)) == 0
+func (uintPtrOpFloat64) zero(u unsafe.Pointer) bool {
+	return *(*float64)(u) == 0
+}
+func (uintPtrOpFloat64) marshal(u unsafe.Pointer, s *encoder) {
+	s.Float64(*(*float64)(u))
 }
-func (uintPtrOpFloat64) marshal(u uintptr, s *rye.Serializer) {
-	s.Float64(*(*float64)(unsafe.Pointer(u)))
+func (uintPtrOpFloat64) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*float64)(u) = d.Float64()
 }
-func (uintPtrOpFloat64) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*float64)(unsafe.Pointer(u)) = d.Float64()
+func (uintPtrOpFloat64) wireType() wireType {
+	return wireFixed64
+}
+func (uintPtrOpFloat64) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed32 {
+		return false
+	}
+	*(*float64)(u) = float64(d.Float32())
+	return true
 }
@@ -7,287 +7,394 @@ import (
 
 type uintPtrOpInt struct{}
 
-func (uintPtrOpInt) size(u uintptr) int {
-	i := *(*int)(unsafe.Pointer(u))
+func (uintPtrOpInt) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*int)(u)
 	return rye.CompactInt64Size(int64(i))
 }
-func (uintPtrOpInt) zero(u uintptr) bool {
-	return *(*int)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt) zero(u unsafe.Pointer) bool {
+	return *(*int)(u) == 0
 }
-func (uintPtrOpInt) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*int)(unsafe.Pointer(u))
+func (uintPtrOpInt) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*int)(u)
 	s.CompactInt64(int64(i))
 }
-func (uintPtrOpInt) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpInt) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := int(d.CompactInt64())
-	ptr := (*int)(unsafe.Pointer(u))
+	ptr := (*int)(u)
 	*ptr = i
 }
+func (uintPtrOpInt) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpInt) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*int)(u) = int(d.Int8())
+	return true
+}
 
 type uintPtrOpInt8 struct{}
 
-func (uintPtrOpInt8) size(u uintptr) int {
+func (uintPtrOpInt8) size(u unsafe.Pointer, s *encoder) int {
 	return 1
 }
-func (uintPtrOpInt8) zero(u uintptr) bool {
-	return *(*int8)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt8) zero(u unsafe.Pointer) bool {
+	return *(*int8)(u) == 0
 }
-func (uintPtrOpInt8) marshal(u uintptr, s *rye.Serializer) {
-	s.Int8(*(*int8)(unsafe.Pointer(u)))
+func (uintPtrOpInt8) marshal(u unsafe.Pointer, s *encoder) {
+	s.Int8(*(*int8)(u))
 }
-func (uintPtrOpInt8) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*int8)(unsafe.Pointer(u)) = d.Int8()
+func (uintPtrOpInt8) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*int8)(u) = d.Int8()
+}
+func (uintPtrOpInt8) wireType() wireType {
+	return wireFixed8
 }
 
 type uintPtrOpInt16C struct{}
 
-func (uintPtrOpInt16C) size(u uintptr) int {
-	i := *(*int16)(unsafe.Pointer(u))
+func (uintPtrOpInt16C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*int16)(u)
 	return rye.CompactInt64Size(int64(i))
 }
-func (uintPtrOpInt16C) zero(u uintptr) bool {
-	return *(*int16)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt16C) zero(u unsafe.Pointer) bool {
+	return *(*int16)(u) == 0
 }
-func (uintPtrOpInt16C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*int16)(unsafe.Pointer(u))
+func (uintPtrOpInt16C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*int16)(u)
 	s.CompactInt64(int64(i))
 }
-func (uintPtrOpInt16C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpInt16C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := int16(d.CompactInt64())
-	ptr := (*int16)(unsafe.Pointer(u))
+	ptr := (*int16)(u)
 	*ptr = i
 }
+func (uintPtrOpInt16C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpInt16C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*int16)(u) = int16(d.Int8())
+	return true
+}
 
 type uintPtrOpInt16 struct{}
 
-func (uintPtrOpInt16) size(u uintptr) int {
+func (uintPtrOpInt16) size(u unsafe.Pointer, s *encoder) int {
 	return 2
 }
-func (uintPtrOpInt16) zero(u uintptr) bool {
-	return *(*int16)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt16) zero(u unsafe.Pointer) bool {
+	return *(*int16)(u) == 0
+}
+func (uintPtrOpInt16) marshal(u unsafe.Pointer, s *encoder) {
+	s.Int16(*(*int16)(u))
 }
-func (uintPtrOpInt16) marshal(u uintptr, s *rye.Serializer) {
-	s.Int16(*(*int16)(unsafe.Pointer(u)))
+func (uintPtrOpInt16) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*int16)(u) = d.Int16()
 }
-func (uintPtrOpInt16) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*int16)(unsafe.Pointer(u)) = d.Int16()
+func (uintPtrOpInt16) wireType() wireType {
+	return wireFixed16
 }
 
 type uintPtrOpInt32C struct{}
 
-func (uintPtrOpInt32C) size(u uintptr) int {
-	i := *(*int32)(unsafe.Pointer(u))
+func (uintPtrOpInt32C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*int32)(u)
 	return rye.CompactInt64Size(int64(i))
 }
-func (uintPtrOpInt32C) zero(u uintptr) bool {
-	return *(*int32)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt32C) zero(u unsafe.Pointer) bool {
+	return *(*int32)(u) == 0
 }
-func (uintPtrOpInt32C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*int32)(unsafe.Pointer(u))
+func (uintPtrOpInt32C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*int32)(u)
 	s.CompactInt64(int64(i))
 }
-func (uintPtrOpInt32C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpInt32C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := int32(d.CompactInt64())
-	ptr := (*int32)(unsafe.Pointer(u))
+	ptr := (*int32)(u)
 	*ptr = i
 }
+func (uintPtrOpInt32C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpInt32C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*int32)(u) = int32(d.Int8())
+	return true
+}
 
 type uintPtrOpInt32 struct{}
 
-func (uintPtrOpInt32) size(u uintptr) int {
+func (uintPtrOpInt32) size(u unsafe.Pointer, s *encoder) int {
 	return 4
 }
-func (uintPtrOpInt32) zero(u uintptr) bool {
-	return *(*int32)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt32) zero(u unsafe.Pointer) bool {
+	return *(*int32)(u) == 0
+}
+func (uintPtrOpInt32) marshal(u unsafe.Pointer, s *encoder) {
+	s.Int32(*(*int32)(u))
 }
-func (uintPtrOpInt32) marshal(u uintptr, s *rye.Serializer) {
-	s.Int32(*(*int32)(unsafe.Pointer(u)))
+func (uintPtrOpInt32) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*int32)(u) = d.Int32()
 }
-func (uintPtrOpInt32) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*int32)(unsafe.Pointer(u)) = d.Int32()
+func (uintPtrOpInt32) wireType() wireType {
+	return wireFixed32
 }
 
 type uintPtrOpInt64C struct{}
 
-func (uintPtrOpInt64C) size(u uintptr) int {
-	i := *(*int64)(unsafe.Pointer(u))
+func (uintPtrOpInt64C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*int64)(u)
 	return rye.CompactInt64Size(i)
 }
-func (uintPtrOpInt64C) zero(u uintptr) bool {
-	return *(*int64)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt64C) zero(u unsafe.Pointer) bool {
+	return *(*int64)(u) == 0
 }
-func (uintPtrOpInt64C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*int64)(unsafe.Pointer(u))
+func (uintPtrOpInt64C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*int64)(u)
 	s.CompactInt64(i)
 }
-func (uintPtrOpInt64C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpInt64C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := d.CompactInt64()
-	ptr := (*int64)(unsafe.Pointer(u))
+	ptr := (*int64)(u)
 	*ptr = i
 }
+func (uintPtrOpInt64C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpInt64C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*int64)(u) = int64(d.Int8())
+	return true
+}
 
 type uintPtrOpInt64 struct{}
 
-func (uintPtrOpInt64) size(u uintptr) int {
+func (uintPtrOpInt64) size(u unsafe.Pointer, s *encoder) int {
 	return 8
 }
-func (uintPtrOpInt64) zero(u uintptr) bool {
-	return *(*int64)(unsafe.Pointer(u)) == 0
+func (uintPtrOpInt64) zero(u unsafe.Pointer) bool {
+	return *(*int64)(u) == 0
+}
+func (uintPtrOpInt64) marshal(u unsafe.Pointer, s *encoder) {
+	s.Int64(*(*int64)(u))
 }
-func (uintPtrOpInt64) marshal(u uintptr, s *rye.Serializer) {
-	s.Int64(*(*int64)(unsafe.Pointer(u)))
+func (uintPtrOpInt64) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*int64)(u) = d.Int64()
 }
-func (uintPtrOpInt64) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*int64)(unsafe.Pointer(u)) = d.Int64()
+func (uintPtrOpInt64) wireType() wireType {
+	return wireFixed64
 }
 
 type uintPtrOpUint struct{}
 
-func (uintPtrOpUint) size(u uintptr) int {
-	i := *(*uint)(unsafe.Pointer(u))
+func (uintPtrOpUint) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*uint)(u)
 	return rye.CompactUint64Size(uint64(i))
 }
-func (uintPtrOpUint) zero(u uintptr) bool {
-	return *(*uint)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint) zero(u unsafe.Pointer) bool {
+	return *(*uint)(u) == 0
 }
-func (uintPtrOpUint) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*uint)(unsafe.Pointer(u))
+func (uintPtrOpUint) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*uint)(u)
 	s.CompactUint64(uint64(i))
 }
-func (uintPtrOpUint) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpUint) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := uint(d.CompactUint64())
-	ptr := (*uint)(unsafe.Pointer(u))
+	ptr := (*uint)(u)
 	*ptr = i
 }
+func (uintPtrOpUint) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpUint) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*uint)(u) = uint(d.Byte())
+	return true
+}
 
 type uintPtrOpUint8 struct{}
 
-func (uintPtrOpUint8) size(u uintptr) int {
+func (uintPtrOpUint8) size(u unsafe.Pointer, s *encoder) int {
 	return 1
 }
-func (uintPtrOpUint8) zero(u uintptr) bool {
-	return *(*uint8)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint8) zero(u unsafe.Pointer) bool {
+	return *(*uint8)(u) == 0
+}
+func (uintPtrOpUint8) marshal(u unsafe.Pointer, s *encoder) {
+	s.Uint8(*(*uint8)(u))
 }
-func (uintPtrOpUint8) marshal(u uintptr, s *rye.Serializer) {
-	s.Uint8(*(*uint8)(unsafe.Pointer(u)))
+func (uintPtrOpUint8) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*uint8)(u) = d.Uint8()
 }
-func (uintPtrOpUint8) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*uint8)(unsafe.Pointer(u)) = d.Uint8()
+func (uintPtrOpUint8) wireType() wireType {
+	return wireFixed8
 }
 
 type uintPtrOpByte struct{}
 
-func (uintPtrOpByte) size(u uintptr) int {
+func (uintPtrOpByte) size(u unsafe.Pointer, s *encoder) int {
 	return 1
 }
-func (uintPtrOpByte) zero(u uintptr) bool {
-	return *(*byte)(unsafe.Pointer(u)) == 0
+func (uintPtrOpByte) zero(u unsafe.Pointer) bool {
+	return *(*byte)(u) == 0
+}
+func (uintPtrOpByte) marshal(u unsafe.Pointer, s *encoder) {
+	s.Byte(*(*byte)(u))
 }
-func (uintPtrOpByte) marshal(u uintptr, s *rye.Serializer) {
-	s.Byte(*(*byte)(unsafe.Pointer(u)))
+func (uintPtrOpByte) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*byte)(u) = d.Byte()
 }
-func (uintPtrOpByte) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*byte)(unsafe.Pointer(u)) = d.Byte()
+func (uintPtrOpByte) wireType() wireType {
+	return wireFixed8
 }
 
 type uintPtrOpUint16C struct{}
 
-func (uintPtrOpUint16C) size(u uintptr) int {
-	i := *(*uint16)(unsafe.Pointer(u))
+func (uintPtrOpUint16C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*uint16)(u)
 	return rye.CompactUint64Size(uint64(i))
 }
-func (uintPtrOpUint16C) zero(u uintptr) bool {
-	return *(*uint16)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint16C) zero(u unsafe.Pointer) bool {
+	return *(*uint16)(u) == 0
 }
-func (uintPtrOpUint16C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*uint16)(unsafe.Pointer(u))
+func (uintPtrOpUint16C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*uint16)(u)
 	s.CompactUint64(uint64(i))
 }
-func (uintPtrOpUint16C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpUint16C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := uint16(d.CompactUint64())
-	ptr := (*uint16)(unsafe.Pointer(u))
+	ptr := (*uint16)(u)
 	*ptr = i
 }
+func (uintPtrOpUint16C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpUint16C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*uint16)(u) = uint16(d.Byte())
+	return true
+}
 
 type uintPtrOpUint16 struct{}
 
-func (uintPtrOpUint16) size(u uintptr) int {
+func (uintPtrOpUint16) size(u unsafe.Pointer, s *encoder) int {
 	return 2
 }
-func (uintPtrOpUint16) zero(u uintptr) bool {
-	return *(*uint16)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint16) zero(u unsafe.Pointer) bool {
+	return *(*uint16)(u) == 0
+}
+func (uintPtrOpUint16) marshal(u unsafe.Pointer, s *encoder) {
+	s.Uint16(*(*uint16)(u))
 }
-func (uintPtrOpUint16) marshal(u uintptr, s *rye.Serializer) {
-	s.Uint16(*(*uint16)(unsafe.Pointer(u)))
+func (uintPtrOpUint16) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*uint16)(u) = d.Uint16()
 }
-func (uintPtrOpUint16) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*uint16)(unsafe.Pointer(u)) = d.Uint16()
+func (uintPtrOpUint16) wireType() wireType {
+	return wireFixed16
 }
 
 type uintPtrOpUint32C struct{}
 
-func (uintPtrOpUint32C) size(u uintptr) int {
-	i := *(*uint32)(unsafe.Pointer(u))
+func (uintPtrOpUint32C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*uint32)(u)
 	return rye.CompactUint64Size(uint64(i))
 }
-func (uintPtrOpUint32C) zero(u uintptr) bool {
-	return *(*uint32)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint32C) zero(u unsafe.Pointer) bool {
+	return *(*uint32)(u) == 0
 }
-func (uintPtrOpUint32C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*uint32)(unsafe.Pointer(u))
+func (uintPtrOpUint32C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*uint32)(u)
 	s.CompactUint64(uint64(i))
 }
-func (uintPtrOpUint32C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpUint32C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := uint32(d.CompactUint64())
-	ptr := (*uint32)(unsafe.Pointer(u))
+	ptr := (*uint32)(u)
 	*ptr = i
 }
+func (uintPtrOpUint32C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpUint32C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*uint32)(u) = uint32(d.Byte())
+	return true
+}
 
 type uintPtrOpUint32 struct{}
 
-func (uintPtrOpUint32) size(u uintptr) int {
+func (uintPtrOpUint32) size(u unsafe.Pointer, s *encoder) int {
 	return 4
 }
-func (uintPtrOpUint32) zero(u uintptr) bool {
-	return *(*uint32)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint32) zero(u unsafe.Pointer) bool {
+	return *(*uint32)(u) == 0
+}
+func (uintPtrOpUint32) marshal(u unsafe.Pointer, s *encoder) {
+	s.Uint32(*(*uint32)(u))
 }
-func (uintPtrOpUint32) marshal(u uintptr, s *rye.Serializer) {
-	s.Uint32(*(*uint32)(unsafe.Pointer(u)))
+func (uintPtrOpUint32) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*uint32)(u) = d.Uint32()
 }
-func (uintPtrOpUint32) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*uint32)(unsafe.Pointer(u)) = d.Uint32()
+func (uintPtrOpUint32) wireType() wireType {
+	return wireFixed32
 }
 
 type uintPtrOpUint64C struct{}
 
-func (uintPtrOpUint64C) size(u uintptr) int {
-	i := *(*uint64)(unsafe.Pointer(u))
+func (uintPtrOpUint64C) size(u unsafe.Pointer, s *encoder) int {
+	i := *(*uint64)(u)
 	return rye.CompactUint64Size(i)
 }
-func (uintPtrOpUint64C) zero(u uintptr) bool {
-	return *(*uint64)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint64C) zero(u unsafe.Pointer) bool {
+	return *(*uint64)(u) == 0
 }
-func (uintPtrOpUint64C) marshal(u uintptr, s *rye.Serializer) {
-	i := *(*uint64)(unsafe.Pointer(u))
+func (uintPtrOpUint64C) marshal(u unsafe.Pointer, s *encoder) {
+	i := *(*uint64)(u)
 	s.CompactUint64(i)
 }
-func (uintPtrOpUint64C) unmarshal(u uintptr, d *rye.Deserializer) {
+func (uintPtrOpUint64C) unmarshal(u unsafe.Pointer, d *decoder) {
 	i := d.CompactUint64()
-	ptr := (*uint64)(unsafe.Pointer(u))
+	ptr := (*uint64)(u)
 	*ptr = i
 }
+func (uintPtrOpUint64C) wireType() wireType {
+	return wireVarint
+}
+func (uintPtrOpUint64C) widen(wt wireType, u unsafe.Pointer, d *decoder) bool {
+	if wt != wireFixed8 {
+		return false
+	}
+	*(*uint64)(u) = uint64(d.Byte())
+	return true
+}
 
 type uintPtrOpUint64 struct{}
 
-func (uintPtrOpUint64) size(u uintptr) int {
+func (uintPtrOpUint64) size(u unsafe.Pointer, s *encoder) int {
 	return 8
 }
-func (uintPtrOpUint64) zero(u uintptr) bool {
-	return *(*uint64)(unsafe.Pointer(u)) == 0
+func (uintPtrOpUint64) zero(u unsafe.Pointer) bool {
+	return *(*uint64)(u) == 0
+}
+func (uintPtrOpUint64) marshal(u unsafe.Pointer, s *encoder) {
+	s.Uint64(*(*uint64)(u))
 }
-func (uintPtrOpUint64) marshal(u uintptr, s *rye.Serializer) {
-	s.Uint64(*(*uint64)(unsafe.Pointer(u)))
+func (uintPtrOpUint64) unmarshal(u unsafe.Pointer, d *decoder) {
+	*(*uint64)(u) = d.Uint64()
 }
-func (uintPtrOpUint64) unmarshal(u uintptr, d *rye.Deserializer) {
-	*(*uint64)(unsafe.Pointer(u)) = d.Uint64()
+func (uintPtrOpUint64) wireType() wireType {
+	return wireFixed64
 }
@@ -0,0 +1,88 @@
+package thresher
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// Validator is implemented by structs that check themselves once they are
+// decoded. Validate is called on each struct after its fields are decoded,
+// including when merging; an error is returned by Unmarshal as ErrInvalid
+// with the path of the struct.
+type Validator interface {
+	Validate() error
+}
+
+var validatorType = reflect.TypeOf((*Validator)(nil)).Elem()
+
+// maxRequired is the most fields with the required option a struct can have;
+// the fields that have been seen are kept in a uint64.
+const maxRequired = 64
+
+// pathError is implemented by errors that record where in the decoded value
+// they happened. withPath returns the error with p prepended to its path.
+type pathError interface {
+	withPath(p string) error
+}
+
+// prefixPath prepends p to the path of r if it is a pathError.
+func prefixPath(r interface{}, p string) interface{} {
+	if pe, ok := r.(pathError); ok {
+		return pe.withPath(p)
+	}
+	return r
+}
+
+// recoverRoot names the root value of type rt in the path of a panicking error.
+// It must be deferred.
+func recoverRoot(rt reflect.Type) {
+	if r := recover(); r != nil {
+		for rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		name := rt.Name()
+		if name == "" {
+			name = rt.String()
+		}
+		panic(prefixPath(r, name))
+	}
+}
+
+// recoverElem adds the index of a slice element to the path of a panicking error.
+// It must be deferred.
+func recoverElem(i *uintptr) {
+	if r := recover(); r != nil {
+		panic(prefixPath(r, fmt.Sprintf("[%d]", *i)))
+	}
+}
+
+// recoverField adds the name of a field to the path of a panicking error. An
+// empty name is an error from the struct itself. It must be deferred.
+func recoverField(name *string) {
+	if r := recover(); r != nil {
+		if *name != "" {
+			r = prefixPath(r, "."+*name)
+		}
+		panic(r)
+	}
+}
+
+// checkFields panics if a required field of the struct at base was not seen
+// and calls its Validate method.
+func (sm structMarshaller) checkFields(base unsafe.Pointer, seen uint64, mergeInto bool) {
+	if sm.required > 0 && !mergeInto && seen != uint64(1)<<sm.required-1 {
+		var missing []string
+		for _, f := range sm.byOrder {
+			if f.required > 0 && seen&f.requiredBit() == 0 {
+				missing = append(missing, "."+f.name)
+			}
+		}
+		panic(ErrRequired{missing})
+	}
+	if sm.validate {
+		if err := reflect.NewAt(sm.rt, base).Interface().(Validator).Validate(); err != nil {
+			panic(ErrInvalid{Err: err})
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package thresher
+
+import (
+	"fmt"
+
+	"github.com/adamcolton/rye"
+)
+
+// wireType is carried in the low bits of every field header so that a reader
+// can skip a field it does not know about.
+type wireType uint8
+
+const (
+	// wireVarint is a Compact Uint64 or Compact Int64
+	wireVarint wireType = iota
+	wireFixed8
+	wireFixed16
+	wireFixed32
+	wireFixed64
+	// wireBytes is a Compact Uint64 length followed by that many bytes
+	wireBytes
+	// wireGroup is a sequence of fields terminated by a 0 header
+	wireGroup
+
+	wireTypeBits           = 3
+	wireTypeMask  uint64   = 1<<wireTypeBits - 1
+	maxFieldID    uint64   = 1<<(64-wireTypeBits) - 1
+	wireTypeLimit wireType = wireGroup + 1
+)
+
+var wireTypeNames = [...]string{
+	wireVarint:  "varint",
+	wireFixed8:  "fixed8",
+	wireFixed16: "fixed16",
+	wireFixed32: "fixed32",
+	wireFixed64: "fixed64",
+	wireBytes:   "bytes",
+	wireGroup:   "group",
+}
+
+func (wt wireType) String() string {
+	if wt < wireTypeLimit {
+		return wireTypeNames[wt]
+	}
+	return fmt.Sprintf("wireType(%d)", uint8(wt))
+}
+
+func makeHeader(id uint64, wt wireType) uint64 {
+	return id<<wireTypeBits | uint64(wt)
+}
+
+func splitHeader(header uint64) (uint64, wireType) {
+	return header >> wireTypeBits, wireType(header & wireTypeMask)
+}
+
+// ErrWireType is returned when data contains a wire type that cannot be
+// decoded.
+type ErrWireType struct {
+	WireType uint8
+}
+
+func (e ErrWireType) Error() string {
+	return fmt.Sprintf("thresher: unknown wire type %d", e.WireType)
+}
+
+// skipWire advances the Deserializer past one value of the given wire type.
+// depth is how deeply the value is nested; groups nested more than maxDepth
+// deep are rejected rather than exhausting the stack.
+func skipWire(wt wireType, d *rye.Deserializer, depth, maxDepth int) {
+	switch wt {
+	case wireVarint:
+		d.CompactUint64()
+	case wireFixed8:
+		d.Slice(1)
+	case wireFixed16:
+		d.Slice(2)
+	case wireFixed32:
+		d.Slice(4)
+	case wireFixed64:
+		d.Slice(8)
+	case wireBytes:
+		d.Slice(int(d.CompactUint64()))
+	case wireGroup:
+		depth = checkDepth(depth+1, maxDepth)
+		for {
+			header := d.CompactUint64()
+			if header == 0 {
+				return
+			}
+			_, fwt := splitHeader(header)
+			skipWire(fwt, d, depth, maxDepth)
+		}
+	default:
+		panic(ErrWireType{uint8(wt)})
+	}
+}
+
+// skip advances past one value of the given wire type nested in the value
+// being decoded.
+func (d *decoder) skip(wt wireType) {
+	skipWire(wt, d.Deserializer, d.depth, d.limits.MaxDepth)
+}
+
+// UnknownFields can be included in a struct to preserve fields that were not
+// recognized during Unmarshal. They are written back out by Marshal so that
+// data from a newer writer can round trip through an older reader. The field
+// does not need a RyeField tag.
+type UnknownFields []byte